@@ -0,0 +1,61 @@
+package brpc
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+// Backoff decides how long to wait before an attempt to reconnect or to retry a
+// call, see ReconnectPolicy.Backoff and RetryPolicy.Backoff. Implementations
+// must be safe for concurrent use.
+type Backoff interface {
+	// NextInterval returns the delay before the next attempt, after attempt
+	// consecutive attempts, starting at 1.
+	NextInterval(attempt int) time.Duration
+}
+
+// ExponentialBackoff starts with the Initial delay and doubles it after every
+// attempt up to Max. Defaults to 1s and 30s.
+type ExponentialBackoff struct {
+	Initial time.Duration
+	Max     time.Duration
+
+	// Jitter adds up to this fraction of the delay as a random delay, so that
+	// many clients don't retry in lockstep. For example 0.2 adds up to 20%.
+	Jitter float64
+}
+
+func (b ExponentialBackoff) NextInterval(attempt int) time.Duration {
+	initial, maxInterval := b.Initial, b.Max
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	if maxInterval <= 0 {
+		maxInterval = defaultMaxBackoff
+	}
+	d := initial
+	for i := 1; i < attempt && d < maxInterval; i++ {
+		d *= 2
+	}
+	if d > maxInterval {
+		d = maxInterval
+	}
+	if b.Jitter > 0 {
+		d += time.Duration(rand.Float64() * b.Jitter * float64(d))
+	}
+	return d
+}
+
+// ConstantBackoff waits the same Interval before every attempt.
+type ConstantBackoff struct {
+	Interval time.Duration
+}
+
+func (b ConstantBackoff) NextInterval(int) time.Duration {
+	return b.Interval
+}
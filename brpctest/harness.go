@@ -0,0 +1,88 @@
+package brpctest
+
+import (
+	"context"
+	"github.com/clarkmcc/brpc"
+	"google.golang.org/grpc"
+	"testing"
+	"time"
+)
+
+// shutdownTimeout bounds how long the harness waits for the server to drain when
+// the test finishes.
+const shutdownTimeout = 5 * time.Second
+
+// Harness is a brpc server and client that are connected in memory.
+type Harness[C any] struct {
+	Server   *brpc.Server[C]
+	Client   *brpc.ClientConn
+	Listener *Listener
+}
+
+// HarnessConfig configures NewHarness.
+type HarnessConfig[C any] struct {
+	// Server configures the brpc server. If Server.Server is nil, a gRPC server
+	// with the brpc server's interceptors is created.
+	Server brpc.ServerConfig[C]
+	// RegisterServer registers the services served to the client. It receives the
+	// brpc server so that services can look up clients with ClientFromContext.
+	RegisterServer func(server *brpc.Server[C], registrar grpc.ServiceRegistrar)
+	// RegisterClient registers the services that the client serves to the server.
+	RegisterClient func(registrar grpc.ServiceRegistrar)
+	// DialOptions are passed to brpc.DialContext, the in-memory transport is
+	// always used.
+	DialOptions []brpc.DialOption
+}
+
+// NewHarness starts a brpc server and connects a client to it in memory. Both are
+// shut down when the test finishes. Connections have no TLS state, so servers
+// that require client certificates can't be tested with the harness.
+func NewHarness[C any](t testing.TB, config HarnessConfig[C]) *Harness[C] {
+	t.Helper()
+
+	server := brpc.NewServer(config.Server)
+	if config.RegisterServer != nil {
+		config.RegisterServer(server, server.Server)
+	}
+	listener := NewListener()
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := server.ServeListener(context.Background(), listener); err != nil {
+			t.Errorf("serving: %v", err)
+		}
+	}()
+
+	opts := append(config.DialOptions, brpc.WithTransport(listener.Transport()))
+	client, err := brpc.DialContext(context.Background(), "pipe", nil, opts...)
+	if err != nil {
+		server.Stop()
+		<-served
+		t.Fatalf("dialing: %v", err)
+	}
+	shutdown := make(chan struct{})
+	clientServed := make(chan struct{})
+	go func() {
+		defer close(clientServed)
+		register := config.RegisterClient
+		if register == nil {
+			register = func(grpc.ServiceRegistrar) {}
+		}
+		_ = brpc.ServeClientService[any](shutdown, client, register)
+	}()
+
+	t.Cleanup(func() {
+		close(shutdown)
+		if err := client.Close(); err != nil {
+			t.Logf("closing client: %v", err)
+		}
+		<-clientServed
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("shutting down server: %v", err)
+		}
+		<-served
+	})
+	return &Harness[C]{Server: server, Client: client, Listener: listener}
+}
@@ -0,0 +1,62 @@
+package brpctest_test
+
+import (
+	"context"
+	"github.com/clarkmcc/brpc"
+	"github.com/clarkmcc/brpc/brpctest"
+	"github.com/clarkmcc/brpc/internal/example"
+	"google.golang.org/grpc"
+	"testing"
+	"time"
+)
+
+// namer answers server->client calls with a fixed name.
+type namer struct {
+	example.UnimplementedNamerServer
+}
+
+func (namer) Name(context.Context, *example.NameRequest) (*example.NameResponse, error) {
+	return &example.NameResponse{Name: "harness"}, nil
+}
+
+func TestHarnessServerToClientCall(t *testing.T) {
+	var h *brpctest.Harness[example.NamerClient]
+	ok := t.Run("call", func(t *testing.T) {
+		h = brpctest.NewHarness(t, brpctest.HarnessConfig[example.NamerClient]{
+			Server:         brpc.ServerConfig[example.NamerClient]{ClientServiceBuilder: example.NewNamerClient},
+			RegisterClient: func(registrar grpc.ServiceRegistrar) { example.RegisterNamerServer(registrar, namer{}) },
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		client, err := h.Server.WaitForClient(ctx, h.Client.ID())
+		if err != nil {
+			t.Fatalf("waiting for the client: %v", err)
+		}
+		res, err := client.Name(ctx, &example.NameRequest{})
+		if err != nil {
+			t.Fatalf("calling the client: %v", err)
+		}
+		if res.GetName() != "harness" {
+			t.Errorf("got name %q, want %q", res.GetName(), "harness")
+		}
+	})
+	if !ok {
+		return
+	}
+
+	// The subtest's cleanup shut down both ends
+	select {
+	case <-h.Client.Done():
+	default:
+		t.Error("client is still connected after cleanup")
+	}
+	if _, ok := h.Server.Client(h.Client.ID()); ok {
+		t.Error("server still has the client registered after cleanup")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if conn, err := h.Listener.Dial(ctx); err == nil {
+		_ = conn.CloseWithReason(brpc.ReasonNormal, "")
+		t.Error("server still accepts connections after cleanup")
+	}
+}
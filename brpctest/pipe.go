@@ -0,0 +1,112 @@
+// Package brpctest provides an in-memory transport and a test harness for brpc, so
+// that servers and clients can be tested without binding real sockets.
+package brpctest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/clarkmcc/brpc"
+	"net"
+	"sync"
+)
+
+// NewPipe returns the client and server ends of an in-memory brpc connection. The
+// connection is multiplexed over a net.Pipe, so it behaves like a real connection
+// without any networking.
+func NewPipe() (client, server brpc.Conn, err error) {
+	clientConn, serverConn := net.Pipe()
+	server, err = brpc.NewYamuxConn(serverConn, true, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err = brpc.NewYamuxConn(clientConn, false, nil)
+	if err != nil {
+		_ = server.CloseWithReason(brpc.ReasonInternal, err.Error())
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+var _ brpc.Listener = &Listener{}
+
+// Listener is an in-memory brpc.Listener. Clients connect to it with Dial, or
+// with the Transport returned by Transport.
+type Listener struct {
+	conns     chan brpc.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener returns a Listener that accepts in-memory connections.
+func NewListener() *Listener {
+	return &Listener{
+		conns: make(chan brpc.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Dial connects to the listener, blocking until the connection is accepted.
+func (l *Listener) Dial(ctx context.Context) (brpc.Conn, error) {
+	client, server, err := NewPipe()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-ctx.Done():
+		_ = client.CloseWithReason(brpc.ReasonNormal, "")
+		return nil, ctx.Err()
+	case <-l.done:
+		_ = client.CloseWithReason(brpc.ReasonNormal, "")
+		return nil, fmt.Errorf("dialing in-memory listener: %w", net.ErrClosed)
+	}
+}
+
+func (l *Listener) Accept(ctx context.Context) (brpc.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Transport returns a brpc.Transport whose Dial connects to the listener and whose
+// Listen returns the listener, regardless of the address. TLS configs are ignored,
+// so connections have no TLS state.
+func (l *Listener) Transport() brpc.Transport {
+	return transport{listener: l}
+}
+
+type transport struct {
+	listener *Listener
+}
+
+func (t transport) Dial(ctx context.Context, _ string, _ *tls.Config) (brpc.Conn, error) {
+	return t.listener.Dial(ctx)
+}
+
+func (t transport) Listen(_ string, _ *tls.Config) (brpc.Listener, error) {
+	return t.listener, nil
+}
+
+// pipeAddr is the address of in-memory connections.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,329 @@
+package brpc_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/clarkmcc/brpc"
+	"github.com/clarkmcc/brpc/brpctest"
+	"github.com/clarkmcc/brpc/internal/example"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// callbackGreeter is served by the server and calls back into the calling client.
+type callbackGreeter struct {
+	example.UnimplementedGreeterServer
+	server *brpc.Server[example.NamerClient]
+}
+
+func (g *callbackGreeter) Greet(ctx context.Context, _ *example.GreetRequest) (*example.GreetResponse, error) {
+	client, err := g.server.ClientFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Name(ctx, &example.NameRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return &example.GreetResponse{Greeting: "Hello " + res.GetName()}, nil
+}
+
+func (g *callbackGreeter) GreetAll(ctx context.Context, _ *example.GreetRequest) (*example.GreetResponse, error) {
+	client, err := g.server.ClientFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := client.Names(ctx, &example.NameRequest{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, res.GetName())
+	}
+	return &example.GreetResponse{Greeting: "Hello " + strings.Join(names, ", ")}, nil
+}
+
+func (g *callbackGreeter) GreetStream(_ *example.GreetRequest, stream example.Greeter_GreetStreamServer) error {
+	client, err := g.server.ClientFromContext(stream.Context())
+	if err != nil {
+		return err
+	}
+	names, err := client.NameEach(stream.Context())
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if err := names.Send(&example.NameRequest{}); err != nil {
+			return err
+		}
+		res, err := names.Recv()
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&example.GreetResponse{Greeting: "Hello " + res.GetName()}); err != nil {
+			return err
+		}
+	}
+	if err := names.CloseSend(); err != nil {
+		return err
+	}
+	// The client ends the stream once it sees the half-close.
+	if _, err := names.Recv(); err != io.EOF {
+		return fmt.Errorf("expected the client to end the stream, got %v", err)
+	}
+	return nil
+}
+
+// recordingNamer is served by the client and records the client id that the
+// server sent with every stream.
+type recordingNamer struct {
+	example.UnimplementedNamerServer
+	mu  sync.Mutex
+	ids []string
+}
+
+func (n *recordingNamer) record(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ids = append(n.ids, md.Get(brpc.DefaultClientIDMetadataKey)...)
+}
+
+func (n *recordingNamer) recorded() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.ids...)
+}
+
+func (n *recordingNamer) Names(_ *example.NameRequest, stream example.Namer_NamesServer) error {
+	n.record(stream.Context())
+	for _, name := range []string{"a", "b", "c"} {
+		if err := stream.Send(&example.NameResponse{Name: name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *recordingNamer) NameEach(stream example.Namer_NameEachServer) error {
+	n.record(stream.Context())
+	for i := 0; ; i++ {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&example.NameResponse{Name: fmt.Sprint(i)}); err != nil {
+			return err
+		}
+	}
+}
+
+func TestStreamingCallbacks(t *testing.T) {
+	namer := &recordingNamer{}
+	h := brpctest.NewHarness(t, brpctest.HarnessConfig[example.NamerClient]{
+		Server: brpc.ServerConfig[example.NamerClient]{ClientServiceBuilder: example.NewNamerClient},
+		RegisterServer: func(server *brpc.Server[example.NamerClient], registrar grpc.ServiceRegistrar) {
+			example.RegisterGreeterServer(registrar, &callbackGreeter{server: server})
+		},
+		RegisterClient: func(registrar grpc.ServiceRegistrar) {
+			example.RegisterNamerServer(registrar, namer)
+		},
+	})
+	client := example.NewGreeterClient(h.Client)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	res, err := client.GreetAll(ctx, &example.GreetRequest{})
+	if err != nil {
+		t.Fatalf("GreetAll: %v", err)
+	}
+	if got, want := res.GetGreeting(), "Hello a, b, c"; got != want {
+		t.Errorf("GreetAll = %q, want %q", got, want)
+	}
+
+	stream, err := client.GreetStream(ctx, &example.GreetRequest{})
+	if err != nil {
+		t.Fatalf("GreetStream: %v", err)
+	}
+	var greetings []string
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("receiving greeting: %v", err)
+		}
+		greetings = append(greetings, res.GetGreeting())
+	}
+	if got, want := strings.Join(greetings, "; "), "Hello 0; Hello 1; Hello 2"; got != want {
+		t.Errorf("GreetStream = %q, want %q", got, want)
+	}
+
+	// Every server->client stream carries the id of the client it was opened to.
+	ids := namer.recorded()
+	if len(ids) != 2 {
+		t.Fatalf("got client ids %v for 2 streams", ids)
+	}
+	for _, id := range ids {
+		if id != h.Client.ID().String() {
+			t.Errorf("got client id %s, want %s", id, h.Client.ID())
+		}
+	}
+}
+
+// newCallbackHarness connects a client serving namer to a server serving
+// callbackGreeter.
+func newCallbackHarness(t *testing.T, namer example.NamerServer) *brpctest.Harness[example.NamerClient] {
+	return brpctest.NewHarness(t, brpctest.HarnessConfig[example.NamerClient]{
+		Server: brpc.ServerConfig[example.NamerClient]{ClientServiceBuilder: example.NewNamerClient},
+		RegisterServer: func(server *brpc.Server[example.NamerClient], registrar grpc.ServiceRegistrar) {
+			example.RegisterGreeterServer(registrar, &callbackGreeter{server: server})
+		},
+		RegisterClient: func(registrar grpc.ServiceRegistrar) {
+			example.RegisterNamerServer(registrar, namer)
+		},
+	})
+}
+
+// deadlineNamer answers with the time left until the deadline of the call.
+type deadlineNamer struct {
+	example.UnimplementedNamerServer
+}
+
+func (deadlineNamer) Name(ctx context.Context, _ *example.NameRequest) (*example.NameResponse, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return &example.NameResponse{Name: "no deadline"}, nil
+	}
+	return &example.NameResponse{Name: time.Until(deadline).String()}, nil
+}
+
+func TestCallbackInheritsDeadline(t *testing.T) {
+	h := newCallbackHarness(t, deadlineNamer{})
+	const timeout = 2 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	res, err := example.NewGreeterClient(h.Client).Greet(ctx, &example.GreetRequest{})
+	if err != nil {
+		t.Fatalf("Greet: %v", err)
+	}
+	left, err := time.ParseDuration(strings.TrimPrefix(res.GetGreeting(), "Hello "))
+	if err != nil {
+		t.Fatalf("the client's handler saw no deadline: %q", res.GetGreeting())
+	}
+	// The callback gets what is left of the original call's deadline.
+	if left <= 0 || left > timeout {
+		t.Errorf("the client's handler had %v left, want at most %v", left, timeout)
+	}
+}
+
+// blockingNamer blocks until the call is cancelled, reporting why on done.
+type blockingNamer struct {
+	example.UnimplementedNamerServer
+	started chan struct{}
+	done    chan error
+}
+
+func (n blockingNamer) Name(ctx context.Context, _ *example.NameRequest) (*example.NameResponse, error) {
+	close(n.started)
+	<-ctx.Done()
+	n.done <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestCallbackCancelledWithCall(t *testing.T) {
+	namer := blockingNamer{started: make(chan struct{}), done: make(chan error, 1)}
+	h := newCallbackHarness(t, namer)
+	ctx, cancel := context.WithCancel(context.Background())
+	called := make(chan error, 1)
+	go func() {
+		_, err := example.NewGreeterClient(h.Client).Greet(ctx, &example.GreetRequest{})
+		called <- err
+	}()
+
+	select {
+	case <-namer.started:
+	case <-time.After(testTimeout):
+		t.Fatal("the server didn't call the client")
+	}
+	cancel()
+	select {
+	case err := <-namer.done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("the client's handler saw %v, want context.Canceled", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the client's handler wasn't cancelled along with the call")
+	}
+	if err := <-called; status.Code(err) != codes.Canceled {
+		t.Errorf("Greet failed with %v, want codes.Canceled", err)
+	}
+}
+
+// servicesGreeter looks up the calling client's stubs by their type.
+type servicesGreeter struct {
+	example.UnimplementedGreeterServer
+	server *brpc.Server[any]
+}
+
+func (g *servicesGreeter) Greet(ctx context.Context, _ *example.GreetRequest) (*example.GreetResponse, error) {
+	namer, err := brpc.ClientServiceFromContext[example.NamerClient](ctx, g.server)
+	if err != nil {
+		return nil, err
+	}
+	res, err := namer.Name(ctx, &example.NameRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return &example.GreetResponse{Greeting: "Hello " + res.GetName()}, nil
+}
+
+func (g *servicesGreeter) GreetAll(ctx context.Context, _ *example.GreetRequest) (*example.GreetResponse, error) {
+	_, err := brpc.ClientServiceFromContext[example.GreeterClient](ctx, g.server)
+	if !errors.Is(err, brpc.ErrClientServiceNotRegistered) {
+		return nil, fmt.Errorf("got %v, want ErrClientServiceNotRegistered", err)
+	}
+	return nil, err
+}
+
+func TestClientServiceFromContext(t *testing.T) {
+	h := brpctest.NewHarness(t, brpctest.HarnessConfig[any]{
+		RegisterServer: func(server *brpc.Server[any], registrar grpc.ServiceRegistrar) {
+			brpc.RegisterClientService(server, example.NewNamerClient)
+			example.RegisterGreeterServer(registrar, &servicesGreeter{server: server})
+		},
+		RegisterClient: func(registrar grpc.ServiceRegistrar) {
+			example.RegisterNamerServer(registrar, deadlineNamer{})
+		},
+	})
+	client := example.NewGreeterClient(h.Client)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if _, err := client.Greet(ctx, &example.GreetRequest{}); err != nil {
+		t.Errorf("calling a registered client service: %v", err)
+	}
+	if _, err := client.GreetAll(ctx, &example.GreetRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("looking up an unregistered client service failed with %v, want codes.FailedPrecondition", err)
+	}
+}
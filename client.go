@@ -3,15 +3,22 @@ package brpc
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"github.com/hashicorp/yamux"
 	"github.com/quic-go/quic-go"
 	"go.uber.org/multierr"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"log/slog"
 	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var DefaultDialer net.Dialer
@@ -21,95 +28,572 @@ var DefaultDialer net.Dialer
 // of these when dialing a brpc server.
 type ServiceRegisterFunc[Service any] func(registrar grpc.ServiceRegistrar)
 
+// DialOption configures how a ClientConn dials and maintains its connection.
+type DialOption func(c *ClientConn)
+
+// WithQUICConfig sets the QUIC configuration used to dial the server, allowing
+// tuning of stream limits, flow control windows and timeouts. WithKeepAlive takes
+// precedence over config.KeepAlivePeriod.
+func WithQUICConfig(config *quic.Config) DialOption {
+	return func(c *ClientConn) {
+		c.quicConfig = config
+	}
+}
+
+// WithHandshakeTimeout bounds how long the client waits for the server to complete
+// the brpc handshake once the QUIC connection is established. If it expires, the
+// connection is closed and dialing fails with ErrHandshakeTimeout. Defaults to 10s.
+func WithHandshakeTimeout(timeout time.Duration) DialOption {
+	return func(c *ClientConn) {
+		c.handshakeTimeout = timeout
+	}
+}
+
+// WithHandshakeInfo sends info to the server during the handshake, before the
+// client is assigned an ID, so that the server can reject incompatible clients
+// early, see ServerConfig.VerifyHandshake.
+func WithHandshakeInfo(info HandshakeInfo) DialOption {
+	return func(c *ClientConn) {
+		c.handshakeInfo = info
+	}
+}
+
+// WithToken sends token to the server during the handshake, for servers that
+// authenticate clients with bearer tokens instead of client certificates, see
+// ServerConfig.Authenticator. It sets HandshakeInfo.Token, so it must come after
+// WithHandshakeInfo if both are used.
+func WithToken(token string) DialOption {
+	return func(c *ClientConn) {
+		c.handshakeInfo.Token = token
+	}
+}
+
+// WithKeepAlive makes the client send QUIC keep-alive packets at the provided
+// period, so that stateful firewalls and NATs don't silently drop an otherwise
+// idle connection. The connection's idle timeout is raised to three periods if
+// it isn't configured otherwise.
+func WithKeepAlive(period time.Duration) DialOption {
+	return func(c *ClientConn) {
+		c.keepAlive = period
+	}
+}
+
+// WithDialer establishes the QUIC connection to a target with dialer instead of
+// quic.DialAddr, for example to go through a proxy or to use an in-memory
+// transport in tests. The dialer is responsible for TLS and the QUIC
+// configuration, so WithQUICConfig and WithKeepAlive don't apply. Connections
+// made after reconnecting or failing over use dialer too.
+func WithDialer(dialer func(ctx context.Context, target string) (quic.Connection, error)) DialOption {
+	return func(c *ClientConn) {
+		c.Dialer = dialer
+	}
+}
+
+// WithPacketConn dials the server over pc instead of a UDP socket of its own,
+// for example to share a socket with a server or to use a socket prepared for
+// NAT traversal. It replaces the Dialer, and connections made after reconnecting
+// or failing over use pc too. The caller owns pc: closing the ClientConn doesn't
+// close it, and pc must stay open as long as the ClientConn is used.
+func WithPacketConn(pc net.PacketConn) DialOption {
+	return func(c *ClientConn) {
+		c.Dialer = func(ctx context.Context, target string) (quic.Connection, error) {
+			addr, err := net.ResolveUDPAddr("udp", target)
+			if err != nil {
+				return nil, err
+			}
+			return quic.Dial(ctx, pc, addr, c.tlsConfig, withKeepAlive(c.quicConfig, c.keepAlive))
+		}
+	}
+}
+
+// WithTransport dials the server using transport instead of the Dialer, for
+// example YamuxTransport where QUIC is blocked. WithQUICConfig and WithKeepAlive
+// only apply to the default QUIC dialer.
+func WithTransport(transport Transport) DialOption {
+	return func(c *ClientConn) {
+		c.transport = transport
+	}
+}
+
+// WithGRPCDialOptions appends options to the ones that the client->server gRPC
+// connection is dialed with, for example to add interceptors or raise the maximum
+// message size with grpc.WithDefaultCallOptions. Options that replace the
+// transport, such as grpc.WithContextDialer, must not be used.
+func WithGRPCDialOptions(options ...grpc.DialOption) DialOption {
+	return func(c *ClientConn) {
+		c.grpcOptions = append(c.grpcOptions, options...)
+	}
+}
+
+// WithMaxMessageSize raises or lowers gRPC's default 4MB limit on the size of
+// messages sent and received by the client, for both client->server and
+// server->client RPCs. Large messages still have to fit through the transport's
+// flow control windows, see ServerConfig.MaxMessageSize.
+func WithMaxMessageSize(size int) DialOption {
+	return func(c *ClientConn) {
+		c.maxMessageSize = size
+	}
+}
+
+// WithClientIDMetadataKey replaces DefaultClientIDMetadataKey as the gRPC
+// metadata key that carries the client id. It must match the server's
+// ServerConfig.ClientIDMetadataKey.
+func WithClientIDMetadataKey(key string) DialOption {
+	return func(c *ClientConn) {
+		c.clientIDKey = clientIDMetadataKey(key)
+	}
+}
+
+// WithDefaultMetadata adds md to the outgoing metadata of every client->server
+// RPC, for example to propagate a tenant ID or a request priority without adding
+// it on every call. Server handlers read it with metadata.FromIncomingContext as
+// usual. Keys that the call's context already sets in its outgoing metadata take
+// precedence, and the client id can't be overridden. Calling it more than once
+// merges the metadata.
+func WithDefaultMetadata(md metadata.MD) DialOption {
+	return func(c *ClientConn) {
+		if c.defaultMetadata == nil {
+			c.defaultMetadata = metadata.MD{}
+		}
+		for key, values := range md {
+			c.defaultMetadata.Append(key, values...)
+		}
+	}
+}
+
+// WithBinaryClientID sends the client id with every client->server RPC in its
+// 16 byte binary form instead of the 36 character string, which saves some
+// overhead for clients with many RPCs. The binary id is sent under the client id
+// metadata key with a "-bin" suffix. The client and server agree on it during the
+// handshake, so the client keeps sending the string form to servers that don't
+// support the binary one.
+func WithBinaryClientID() DialOption {
+	return func(c *ClientConn) {
+		c.binaryClientID = true
+	}
+}
+
+// WithoutCallback makes the ClientConn behave like a plain gRPC client that
+// tunnels over the brpc connection: it doesn't send its client ID with
+// client->server RPCs, and it doesn't serve server->client RPCs, so
+// ServeClientService fails with ErrCallbackDisabled. The client tells the server
+// during the handshake, so the server doesn't open a server->client connection,
+// and ClientFromContext fails for its RPCs with ErrClientHasNoCallbackService.
+func WithoutCallback() DialOption {
+	return func(c *ClientConn) {
+		c.noCallback = true
+	}
+}
+
+// WithClientLogger sets the logger used to report connection lifecycle events.
+// Defaults to slog.Default(), which is also used if logger is nil.
+func WithClientLogger(logger *slog.Logger) DialOption {
+	return func(c *ClientConn) {
+		if logger == nil {
+			logger = slog.Default()
+		}
+		c.Logger = logger
+	}
+}
+
 // ClientConn is a bidirectional gRPC connection that is generic over S, the gRPC
 // server that we're connecting to. Callers use this connection to
 //  1. Serve a gRPC server that is accessible to a brpc server.
 //  2. Construct a gRPC client that can call the gRPC server.
 type ClientConn struct {
+	Logger *slog.Logger
 	Dialer func(ctx context.Context, target string) (quic.Connection, error)
 	*grpc.ClientConn
 
-	conn    quic.Connection // The underlying net.Conn obtained from the Dialer
-	session *yamux.Session  // A session that multiplexes all communication
-	//grpcConn   quic.Stream     // A net.Conn over session reserved for client->server RPCs
-	//grpcStream quic.Stream
-	server *grpc.Server // The gRPC server that is served over the grpcConn for server->client RPCs
-	uuid   uuid.UUID    // The client ID assigned by the server. Must be present on all client->server RPCs.
+	mu         sync.RWMutex // Guards the fields below that are replaced when reconnecting
+	conn       Conn         // The connection obtained from the Transport or Dialer
+	server     *grpc.Server // The gRPC server that is served over the connection for server->client RPCs
+	uuid       uuid.UUID    // The client ID assigned by the server. Must be present on all client->server RPCs.
+	serverInfo ServerInfo   // Sent by the server along with the client ID
+	target     string       // The target that conn was dialed to
+
+	// connChanged is closed and replaced every time a new connection is established
+	// so that the callback server knows to start serving the new connection.
+	connChanged chan struct{}
+
+	targets          *targetSet         // The targets to connect to, a single one unless dialed with DialTargets
+	failover         FailoverPolicy     // Selects the target to connect to out of targets
+	reconnect        *ReconnectPolicy   // Nil when reconnection is disabled
+	retry            *RetryPolicy       // Nil when calls aren't retried
+	queue            *callQueue         // Nil when calls don't wait for reconnections
+	keepAlive        time.Duration      // QUIC keep-alive period, zero disables keep-alives
+	quicConfig       *quic.Config       // Passed to quic.DialAddr, nil uses the quic-go defaults
+	transport        Transport          // Used instead of the Dialer when set
+	tlsConfig        *tls.Config        // Passed to the Transport
+	tracePropagation bool               // Whether gRPC connections are instrumented with OpenTelemetry
+	compression      string             // The default compressor for client->server RPCs
+	grpcOptions      []grpc.DialOption  // Appended to the client->server connection's dial options
+	maxMessageSize   int                // Limits message sizes in both directions, zero keeps the gRPC defaults
+	healthService    bool               // Whether the health service is registered on the callback server
+	handshakeTimeout time.Duration      // Bounds the brpc handshake after the QUIC connection is established
+	ctx              context.Context    // Cancelled when the ClientConn is closed for good
+	cancel           context.CancelFunc // Cancels ctx
+	serving          atomic.Bool        // Set once ServeClientService was called
+	status           atomic.Int32       // A ConnStatus, see State
+	done             chan struct{}      // Closed once the ClientConn is closed for good
+	doneOnce         sync.Once
+	err              error         // Why the ClientConn was closed, set before done is closed
+	pings            *pinger       // Pings sent with Ping, shared by all connections
+	handshakeInfo    HandshakeInfo // Sent to the server during the handshake
+	clientIDKey      string        // The metadata key that carries the client id
+	noCallback       bool          // Disables the client id interceptors and ServeClientService
+	defaultMetadata  metadata.MD   // Added to the outgoing metadata of every client->server RPC
+	binaryClientID   bool          // Whether to offer sending the client id in binary form, see WithBinaryClientID
+	closeOnce        sync.Once
+	closeErr         error
+}
+
+func Dial(target string, config *tls.Config, opts ...DialOption) (*ClientConn, error) {
+	return DialContext(context.Background(), target, config, opts...)
 }
 
-func Dial(target string, config *tls.Config) (*ClientConn, error) {
-	return DialContext(context.Background(), target, config)
+func DialContext(ctx context.Context, target string, config *tls.Config, opts ...DialOption) (*ClientConn, error) {
+	return dialTargets(ctx, []string{target}, config, opts)
 }
 
-func DialContext(ctx context.Context, target string, config *tls.Config) (*ClientConn, error) {
+// DialWithDialer connects to target like DialContext, but establishes the QUIC
+// connection with dialer, see WithDialer.
+func DialWithDialer(ctx context.Context, target string, dialer func(ctx context.Context, target string) (quic.Connection, error), opts ...DialOption) (*ClientConn, error) {
+	return dialTargets(ctx, []string{target}, nil, append([]DialOption{WithDialer(dialer)}, opts...))
+}
+
+func dialTargets(ctx context.Context, targets []string, config *tls.Config, opts []DialOption) (*ClientConn, error) {
+	config = withDefaultNextProtos(config)
 	c := &ClientConn{
-		Dialer: func(ctx context.Context, target string) (quic.Connection, error) {
-			return quic.DialAddr(ctx, target, config, nil)
-		},
+		Logger:      slog.Default(),
+		connChanged: make(chan struct{}),
+		done:        make(chan struct{}),
+		tlsConfig:   config,
+		pings:       newPinger(),
+		clientIDKey: DefaultClientIDMetadataKey,
+	}
+	c.Dialer = func(ctx context.Context, target string) (quic.Connection, error) {
+		return quic.DialAddr(ctx, target, config, withKeepAlive(c.quicConfig, c.keepAlive))
 	}
-	return c, c.connect(ctx, target)
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.targets = newTargetSet(targets, c.failover)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	err := c.connectTargets(ctx)
+	if err != nil {
+		c.terminate(err)
+		c.cancel()
+		return c, err
+	}
+	if c.reconnect != nil {
+		go c.supervise()
+	}
+	return c, nil
 }
 
 func (c *ClientConn) connect(ctx context.Context, target string) (err error) {
-	c.conn, err = c.Dialer(ctx, target)
+	conn, err := c.dial(ctx, target)
 	if err != nil {
-		return err
+		return ErrConnectionNegotiationFailed{code: ErrorCodeDialing, inner: err}
 	}
 	defer func() {
 		if err != nil {
+			reason := ReasonInternal
+			if errors.Is(err, ErrProtocolVersionMismatch) {
+				reason = ReasonProtocolMismatch
+			}
 			multierr.AppendFunc(&err, func() error {
-				return c.conn.CloseWithError(quic.ApplicationErrorCode(quic.InternalError), err.Error())
+				return closeWithReason(conn, reason)
 			})
 		}
 	}()
 
-	c.uuid, err = getClientID(ctx, c.conn)
+	ctx, cancel := withHandshakeTimeout(ctx, c.handshakeTimeout)
+	defer cancel()
+
+	info := c.handshakeInfo
+	if !c.noCallback && !info.hasCapability(CapabilityCallback) {
+		info.Capabilities = append(slices.Clone(info.Capabilities), CapabilityCallback)
+	}
+	if c.binaryClientID && !info.hasCapability(CapabilityBinaryClientID) {
+		info.Capabilities = append(slices.Clone(info.Capabilities), CapabilityBinaryClientID)
+	}
+	err = sendHandshake(ctx, conn, info)
+	if err != nil {
+		return ErrConnectionNegotiationFailed{
+			code:  ErrorCodeSendingHandshake,
+			inner: fmt.Errorf("sending handshake to server: %w", handshakeError(ctx, err)),
+		}
+	}
+	id, serverInfo, err := getClientID(ctx, conn)
+	if reason, ok := ReasonFromError(err); ok && reason == ReasonAuthFailed {
+		err = newStatusError(codes.PermissionDenied, fmt.Errorf("%w: %w", ErrAuthenticationFailed, err))
+	}
 	if err != nil {
-		return fmt.Errorf("getting client id from server: %w", err)
+		return ErrConnectionNegotiationFailed{
+			code:  ErrorCodeReceivingClientID,
+			inner: fmt.Errorf("getting client id from server: %w", handshakeError(ctx, err)),
+		}
 	}
 
 	// Open a stream for the client->server gRPC connection
-	conn, err := c.conn.OpenStreamSync(ctx)
+	stream, err := openTypedStream(ctx, conn, streamTypeGRPCClientToServer)
 	if err != nil {
-		return fmt.Errorf("opening multiplexed client->server gprc connection: %w", err)
+		return ErrConnectionNegotiationFailed{
+			code:  ErrorCodeOpeningGrpcConnection,
+			inner: fmt.Errorf("opening multiplexed client->server gprc connection: %w", handshakeError(ctx, err)),
+		}
 	}
-	c.ClientConn, err = dial(conn,
-		c.WithUnaryConnectionIdentifier(),
-		c.WithStreamConnectionIdentifier(),
-		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	options := append(c.clientDialOptions(), grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(c.unaryMetadataInterceptor),
+		grpc.WithChainStreamInterceptor(c.streamMetadataInterceptor))
+	grpcConn, err := dial(stream, options...)
 	if err != nil {
-		return fmt.Errorf("dialing client->server grpc connection: %w", err)
+		return ErrConnectionNegotiationFailed{
+			code:  ErrorCodeDialingGrpc,
+			inner: fmt.Errorf("dialing client->server grpc connection: %w", err),
+		}
 	}
 
-	//c.server = grpc.NewServer()
-	//register(c.server)
-
-	// Start serving the client's gRPC server
-	//go c.serve()
+	c.mu.Lock()
+	previous := c.ClientConn
+	c.conn = conn
+	c.uuid = id
+	c.serverInfo = serverInfo
+	c.target = target
+	c.ClientConn = grpcConn
+	close(c.connChanged)
+	c.connChanged = make(chan struct{})
+	c.mu.Unlock()
+	if previous != nil {
+		_ = previous.Close()
+	}
+	go serveControl(conn, c.pings, c.Logger)
+	c.setStatus(ConnStatusConnected)
+	if c.reconnect == nil {
+		// Without reconnection, losing the connection is final. If it was
+		// lost because of Close, Close terminates the ClientConn itself.
+		context.AfterFunc(conn.Context(), func() {
+			if c.ctx.Err() == nil {
+				c.terminate(fmt.Errorf("connection lost: %w", context.Cause(conn.Context())))
+			}
+		})
+	}
+	c.Logger.Info("connected to server", "target", target, "id", id)
 	return nil
 }
 
-func (c *ClientConn) serve() error {
-	return c.server.Serve(&quicListener{conn: c.conn})
+// clientDialOptions returns the configurable options for the client->server gRPC
+// connection, ending with the options from WithGRPCDialOptions.
+func (c *ClientConn) clientDialOptions() []grpc.DialOption {
+	options := append(compressionDialOptions(c.compression), tracingDialOptions(c.tracePropagation)...)
+	options = append(options, messageSizeDialOptions(c.maxMessageSize)...)
+	return append(options, c.grpcOptions...)
+}
+
+// callbackServerOptions returns the options for the gRPC server that serves
+// server->client RPCs.
+func (c *ClientConn) callbackServerOptions() []grpc.ServerOption {
+	options := append(tracingServerOptions(c.tracePropagation), messageSizeServerOptions(c.maxMessageSize)...)
+	return append(options,
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             callbackKeepaliveMinTime,
+			PermitWithoutStream: true,
+		}),
+		grpc.ChainUnaryInterceptor(callbackKey(c.clientIDKey).unaryServerInterceptor),
+		grpc.ChainStreamInterceptor(callbackKey(c.clientIDKey).streamServerInterceptor))
+}
+
+// dial connects to target with the configured Transport, or the Dialer if there
+// is none.
+func (c *ClientConn) dial(ctx context.Context, target string) (Conn, error) {
+	if c.transport != nil {
+		conn, err := c.transport.Dial(ctx, target, c.tlsConfig)
+		if err != nil {
+			return nil, alpnError(err, c.tlsConfig)
+		}
+		return conn, nil
+	}
+	conn, err := c.Dialer(ctx, target)
+	if err != nil {
+		return nil, alpnError(err, c.tlsConfig)
+	}
+	return WrapQUICConn(conn), nil
+}
+
+// Invoke implements grpc.ClientConnInterface using the current client->server
+// connection, which may be replaced if the ClientConn reconnects. Calls wait for
+// the reconnection according to WithRequestQueue, and failed calls are retried
+// according to WithRetry.
+func (c *ClientConn) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	if err := c.awaitConnection(ctx); err != nil {
+		return err
+	}
+	if c.retry != nil && c.retry.retries(method) {
+		return c.invokeWithRetry(ctx, method, args, reply, opts...)
+	}
+	return c.grpcConn().Invoke(ctx, method, args, reply, opts...)
+}
+
+// NewStream implements grpc.ClientConnInterface using the current client->server
+// connection, which may be replaced if the ClientConn reconnects.
+func (c *ClientConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return c.grpcConn().NewStream(ctx, desc, method, opts...)
+}
+
+func (c *ClientConn) grpcConn() *grpc.ClientConn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ClientConn
+}
+
+// ID returns the client ID that the server assigned to this connection. The ID
+// changes if the ClientConn reconnects.
+func (c *ClientConn) ID() uuid.UUID {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.uuid
+}
+
+// Ping checks that the connection to the server works in both directions. It
+// sends a ping over the raw connection, below gRPC, and waits for the server to
+// answer it on a stream that the server opens, which is the same direction that
+// server->client RPCs take. It returns early with an error if ctx is done or the
+// connection is closed.
+func (c *ClientConn) Ping(ctx context.Context) error {
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+	if conn == nil {
+		return ErrClientNotConnected
+	}
+	return c.pings.ping(ctx, conn)
+}
+
+// ServerInfo returns the info that the server sent during the handshake of the
+// current connection, see ServerConfig.ServerInfo.
+func (c *ClientConn) ServerInfo() ServerInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.serverInfo
+}
+
+// serve serves the callback server that was registered by ServeClientService on
+// the current connection. When reconnection is enabled, a fresh server is built
+// and registered for every new connection until the ClientConn is closed or
+// shutdown is closed.
+//
+// shutdown is checked under c.mu before every server is built, which is the
+// lock that ServeClientService reads c.server under to stop it, so a server is
+// either never built or stopped once shutdown is closed.
+func (c *ClientConn) serve(shutdown <-chan struct{}, register func(registrar grpc.ServiceRegistrar)) error {
+	for {
+		c.mu.Lock()
+		select {
+		case <-shutdown:
+			c.mu.Unlock()
+			return nil
+		default:
+		}
+		conn, changed := c.conn, c.connChanged
+		c.server = grpc.NewServer(c.callbackServerOptions()...)
+		server := c.server
+		c.mu.Unlock()
+		c.registerCallbackHealth(server)
+		register(server)
+
+		err := server.Serve(newConnListener(conn, streamTypeGRPCServerToClient))
+		select {
+		case <-shutdown:
+			// The server may have been stopped before it started serving, in
+			// which case Serve fails with grpc.ErrServerStopped.
+			return nil
+		default:
+		}
+		if c.reconnect == nil {
+			return err
+		}
+		server.Stop()
+		select {
+		case <-changed:
+		case <-shutdown:
+			return nil
+		case <-c.ctx.Done():
+			return nil
+		}
+	}
 }
 
+// Close stops the callback server, closes the client->server gRPC connection and
+// the underlying QUIC connection. It waits for in-flight server->client RPCs to
+// finish, see CloseContext to bound the wait. It is safe to call Close multiple
+// times, only the first call does any work and subsequent calls return the same
+// error.
 func (c *ClientConn) Close() error {
-	// Close the gRPC server so that .Serve doesn't freak out
-	// Then we close session, which closes all connections made
-	// over the session, as well as the underlying connection.
-	if c.server != nil {
-		// This also closes c.conn
-		c.server.GracefulStop()
+	return c.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but drains the connection for at most as long as
+// ctx allows: the callback server stops accepting new server->client RPCs right
+// away, and once ctx is done the RPCs that are still in flight are cancelled and
+// the returned error wraps ErrForcedClose. Only the first call to Close or
+// CloseContext does any work, so later contexts are ignored.
+func (c *ClientConn) CloseContext(ctx context.Context) error {
+	c.closeOnce.Do(func() {
+		// Cancelling first makes sure the reconnect supervisor and the callback
+		// server don't race us by re-establishing the connection.
+		c.setStatus(ConnStatusClosed)
+		c.cancel()
+		defer c.terminate(nil)
+
+		c.mu.RLock()
+		server, grpcConn, conn, id, target := c.server, c.ClientConn, c.conn, c.uuid, c.target
+		c.mu.RUnlock()
+		c.Logger.Info("closing connection", "target", target, "id", id)
+
+		// Drain the gRPC server so that .Serve doesn't freak out and in-flight
+		// server->client RPCs finish, then close the underlying connection
+		// which closes all streams.
+		if server != nil {
+			c.closeErr = multierr.Append(c.closeErr, drainServer(ctx, server))
+		}
+		if grpcConn != nil {
+			c.closeErr = multierr.Append(c.closeErr, grpcConn.Close())
+		}
+		if conn != nil {
+			c.closeErr = multierr.Append(c.closeErr, closeWithReason(conn, ReasonNormal))
+		}
+		if c.closeErr != nil {
+			c.Logger.Warn("closing connection", "target", target, "id", id, "error", c.closeErr)
+		}
+	})
+	return c.closeErr
+}
+
+// drainServer gracefully stops server, and stops it forcefully once ctx is done.
+func drainServer(ctx context.Context, server *grpc.Server) error {
+	drained := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		server.Stop()
+		<-drained
+		return fmt.Errorf("%w: %w", ErrForcedClose, ctx.Err())
 	}
-	return nil //c.session.Close()
 }
 
 // WithUnaryConnectionIdentifier is a grpc.DialOption that adds the client's UUID to
 // all unary requests. This is required if the server intends to call back to
 // the client's gRPC server.
 func (c *ClientConn) WithUnaryConnectionIdentifier() grpc.DialOption {
-	return grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
-		ctx = metadata.AppendToOutgoingContext(ctx, metadataClientIDKey, c.uuid.String())
+	return grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx = withClientID(ctx, c.clientIDKey, c.ID())
 		return invoker(ctx, method, req, reply, cc, opts...)
 	})
 }
@@ -118,32 +602,113 @@ func (c *ClientConn) WithUnaryConnectionIdentifier() grpc.DialOption {
 // all stream requests. This is required if the server intends to call back to
 // the client's gRPC server.
 func (c *ClientConn) WithStreamConnectionIdentifier() grpc.DialOption {
-	return grpc.WithStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
-		ctx = metadata.AppendToOutgoingContext(ctx, metadataClientIDKey, c.uuid.String())
+	return grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx = withClientID(ctx, c.clientIDKey, c.ID())
 		return streamer(ctx, desc, cc, method, opts...)
 	})
 }
 
-//// Client constructs a gRPC client for ClientService. It accepts the brpc.ClientConn
-//// and a constructor function generated by protoc.
-//func Client[ClientService any](conn *ClientConn, fn func(cc grpc.ClientConnInterface) ClientService) (ClientService, error) {
-//	var def ClientService
-//	c, err := dial(conn.grpcConn,
-//		conn.WithUnaryConnectionIdentifier(),
-//		conn.WithStreamConnectionIdentifier(),
-//		grpc.WithTransportCredentials(insecure.NewCredentials()))
-//	if err != nil {
-//		return def, err
-//	}
-//	return fn(c), nil
-//}
+// unaryMetadataInterceptor adds the outgoing metadata of every client->server
+// RPC, see outgoingContext.
+func (c *ClientConn) unaryMetadataInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(c.outgoingContext(ctx), method, req, reply, cc, opts...)
+}
+
+// streamMetadataInterceptor adds the outgoing metadata of every client->server
+// RPC, see outgoingContext.
+func (c *ClientConn) streamMetadataInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(c.outgoingContext(ctx), desc, cc, method, opts...)
+}
 
+// outgoingContext merges the metadata from WithDefaultMetadata into the outgoing
+// metadata of ctx, and adds the client id unless callbacks are disabled.
+func (c *ClientConn) outgoingContext(ctx context.Context) context.Context {
+	if len(c.defaultMetadata) > 0 {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		md = md.Copy()
+		for key, values := range c.defaultMetadata {
+			if len(md.Get(key)) == 0 {
+				md.Set(key, values...)
+			}
+		}
+		ctx = metadata.NewOutgoingContext(ctx, md)
+	}
+	if c.noCallback {
+		return ctx
+	}
+	c.mu.RLock()
+	id, binary := c.uuid, c.binaryClientID && c.serverInfo.hasCapability(CapabilityBinaryClientID)
+	c.mu.RUnlock()
+	if binary {
+		return withBinaryClientID(ctx, c.clientIDKey, id)
+	}
+	return withClientID(ctx, c.clientIDKey, id)
+}
+
+// CallbackClientID returns the client id that a server->client RPC was routed to,
+// for use in the handlers of the client's gRPC service. It matches the ID of the
+// ClientConn that the call arrived on, which lets a service implementation that
+// is shared between several ClientConns tell them apart. Errors carry a gRPC
+// status code, like the ones returned by Server.ClientFromContext.
+func CallbackClientID(ctx context.Context) (uuid.UUID, error) {
+	key, ok := ctx.Value(clientIDKeyContextKey{}).(string)
+	if !ok {
+		key = DefaultClientIDMetadataKey
+	}
+	return clientIDFromContext(ctx, key)
+}
+
+// withClientID sets the client id in the outgoing metadata of ctx under key,
+// replacing any ids that were already set so that the server never sees more
+// than one.
+func withClientID(ctx context.Context, key string, id uuid.UUID) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	md.Delete(binaryMetadataKey(key))
+	md.Set(key, id.String())
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// withBinaryClientID is like withClientID, but sets the binary form of the id.
+func withBinaryClientID(ctx context.Context, key string, id uuid.UUID) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	md.Delete(key)
+	md.Set(binaryMetadataKey(key), string(id[:]))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// ServeClientService serves the client's gRPC service so that the brpc server can
+// call it. If the ClientConn was dialed with WithReconnect, register is invoked
+// again against a fresh gRPC server every time the connection is re-established.
+// It can only be called once per ClientConn, later calls return ErrAlreadyServing,
+// and not at all if the ClientConn was dialed WithoutCallback.
+//
+// When the server calls the client from within a handler using the handler's
+// ctx, the ctx passed to the client's handler is cancelled once the original
+// client->server RPC is cancelled or times out, so handlers should watch ctx to
+// avoid doing work that nobody is waiting for.
 func ServeClientService[C any](shutdown <-chan struct{}, c *ClientConn, register ServiceRegisterFunc[C]) error {
-	c.server = grpc.NewServer()
-	register(c.server)
+	if c.noCallback {
+		return ErrCallbackDisabled
+	}
+	if !c.serving.CompareAndSwap(false, true) {
+		return ErrAlreadyServing
+	}
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		<-shutdown
-		c.server.GracefulStop()
+		select {
+		case <-shutdown:
+		case <-done:
+			return
+		}
+		c.mu.RLock()
+		server := c.server
+		c.mu.RUnlock()
+		if server != nil {
+			server.GracefulStop()
+		}
 	}()
-	return c.serve()
+	return c.serve(shutdown, register)
 }
@@ -0,0 +1,88 @@
+package brpc
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const (
+	defaultQueueSize    = 100
+	defaultQueueTimeout = 10 * time.Second
+)
+
+// QueuePolicy controls how client->server unary RPCs wait for the ClientConn to
+// reconnect, see WithRequestQueue.
+type QueuePolicy struct {
+	// Size is the maximum number of calls that wait for the reconnection at the
+	// same time. Defaults to 100.
+	Size int
+
+	// Timeout bounds how long a call waits for the reconnection. Defaults to 10s.
+	Timeout time.Duration
+}
+
+// WithRequestQueue makes client->server unary RPCs that are started while the
+// ClientConn is reconnecting wait until the connection is re-established, and
+// then sends them over the new connection, instead of failing them right away.
+// This smooths over brief network blips, see WithReconnect. Calls fail with an
+// error wrapping ErrClientNotConnected, with codes.Unavailable, if the queue is
+// full, the ClientConn doesn't reconnect within the policy's timeout or is
+// closed for good, and with the code of ctx's error if ctx is done first.
+// Streaming RPCs aren't queued.
+func WithRequestQueue(policy QueuePolicy) DialOption {
+	return func(c *ClientConn) {
+		size, timeout := policy.Size, policy.Timeout
+		if size <= 0 {
+			size = defaultQueueSize
+		}
+		if timeout <= 0 {
+			timeout = defaultQueueTimeout
+		}
+		c.queue = &callQueue{slots: make(chan struct{}, size), timeout: timeout}
+	}
+}
+
+// callQueue bounds the calls that wait for a reconnection.
+type callQueue struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+// awaitConnection returns once the ClientConn has a connection that isn't lost,
+// waiting in the request queue while it reconnects. It returns right away if
+// requests aren't queued.
+func (c *ClientConn) awaitConnection(ctx context.Context) error {
+	if c.queue == nil {
+		return nil
+	}
+	c.mu.RLock()
+	conn, changed := c.conn, c.connChanged
+	c.mu.RUnlock()
+	if conn.Context().Err() == nil {
+		return nil
+	}
+	select {
+	case c.queue.slots <- struct{}{}:
+		defer func() { <-c.queue.slots }()
+	default:
+		return newStatusError(codes.Unavailable, fmt.Errorf("%w: request queue is full", ErrClientNotConnected))
+	}
+	timer := time.NewTimer(c.queue.timeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return nil
+	case <-timer.C:
+		return newStatusError(codes.Unavailable, fmt.Errorf("%w: not reconnected within %s", ErrClientNotConnected, c.queue.timeout))
+	case <-ctx.Done():
+		return newStatusError(status.FromContextError(ctx.Err()).Code(), fmt.Errorf("%w: %w", ErrClientNotConnected, ctx.Err()))
+	case <-c.done:
+		if err := c.Err(); err != nil {
+			return newStatusError(codes.Unavailable, fmt.Errorf("%w: %w", ErrClientNotConnected, err))
+		}
+		return newStatusError(codes.Unavailable, fmt.Errorf("%w: connection closed", ErrClientNotConnected))
+	}
+}
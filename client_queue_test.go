@@ -0,0 +1,116 @@
+package brpc_test
+
+import (
+	"context"
+	"errors"
+	"github.com/clarkmcc/brpc"
+	"github.com/clarkmcc/brpc/internal/example"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+// dropConnection disconnects conn from server and waits until conn noticed and
+// started reconnecting.
+func dropConnection[C any](t *testing.T, server *brpc.Server[C], conn *brpc.ClientConn) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if _, err := server.WaitForClient(ctx, conn.ID()); err != nil {
+		t.Fatalf("waiting for the client: %v", err)
+	}
+	if err := server.DisconnectClient(conn.ID(), ""); err != nil {
+		t.Fatalf("disconnecting: %v", err)
+	}
+	for conn.State().Status != brpc.ConnStatusReconnecting {
+		if ctx.Err() != nil {
+			t.Fatal("client didn't start reconnecting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueuedCallCompletesAfterReconnect(t *testing.T) {
+	greeter := &flakyGreeter{}
+	server := brpc.NewServer(brpc.ServerConfig[example.NamerClient]{ClientServiceBuilder: example.NewNamerClient})
+	example.RegisterGreeterServer(server.Server, greeter)
+	reconnected := make(chan brpc.ReconnectEvent, 1)
+	conn := dial(t, startServer(t, server),
+		brpc.WithReconnect(brpc.ReconnectPolicy{
+			Backoff:     brpc.ConstantBackoff{Interval: 100 * time.Millisecond},
+			OnReconnect: func(event brpc.ReconnectEvent) { reconnected <- event },
+		}),
+		brpc.WithRequestQueue(brpc.QueuePolicy{Timeout: testTimeout}))
+	dropConnection(t, server, conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if _, err := example.NewGreeterClient(conn).Greet(ctx, &example.GreetRequest{}); err != nil {
+		t.Fatalf("queued call failed: %v", err)
+	}
+	select {
+	case event := <-reconnected:
+		if event.Err != nil {
+			t.Fatalf("reconnecting failed: %v", event.Err)
+		}
+	default:
+		t.Fatal("call completed before the client reconnected")
+	}
+}
+
+func TestQueuedCallFailsWithoutConnection(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		queue brpc.QueuePolicy
+		// fill queues calls until the queue is full, returning a func that
+		// cancels them.
+		fill func(t *testing.T, client example.GreeterClient) (cancel func())
+	}{
+		{
+			name:  "timeout",
+			queue: brpc.QueuePolicy{Timeout: 50 * time.Millisecond},
+			fill:  func(*testing.T, example.GreeterClient) func() { return func() {} },
+		},
+		{
+			name:  "queue full",
+			queue: brpc.QueuePolicy{Size: 1, Timeout: testTimeout},
+			fill: func(t *testing.T, client example.GreeterClient) func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					_, _ = client.Greet(ctx, &example.GreetRequest{})
+				}()
+				// Give the call time to take the only slot
+				time.Sleep(50 * time.Millisecond)
+				return func() {
+					cancel()
+					<-done
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := brpc.NewServer(brpc.ServerConfig[example.NamerClient]{ClientServiceBuilder: example.NewNamerClient})
+			example.RegisterGreeterServer(server.Server, &flakyGreeter{})
+			conn := dial(t, startServer(t, server),
+				// The client doesn't reconnect while the test runs
+				brpc.WithReconnect(brpc.ReconnectPolicy{Backoff: brpc.ConstantBackoff{Interval: time.Hour}}),
+				brpc.WithRequestQueue(tc.queue))
+			dropConnection(t, server, conn)
+			client := example.NewGreeterClient(conn)
+			defer tc.fill(t, client)()
+
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			_, err := client.Greet(ctx, &example.GreetRequest{})
+			if !errors.Is(err, brpc.ErrClientNotConnected) {
+				t.Errorf("got %v, want %v", err, brpc.ErrClientNotConnected)
+			}
+			if status.Code(err) != codes.Unavailable {
+				t.Errorf("got code %v, want %v", status.Code(err), codes.Unavailable)
+			}
+		})
+	}
+}
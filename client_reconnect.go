@@ -0,0 +1,111 @@
+package brpc
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ReconnectPolicy controls how a ClientConn re-establishes its connection to the
+// server after the connection is lost.
+type ReconnectPolicy struct {
+	// MaxAttempts is the number of consecutive reconnect attempts before giving
+	// up. Zero means retry forever.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first reconnect attempt. The delay
+	// doubles after every failed attempt up to MaxBackoff. Defaults to 1s and 30s.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Jitter adds up to this fraction of the backoff as a random delay, so that
+	// many clients don't reconnect in lockstep. For example 0.2 adds up to 20%.
+	Jitter float64
+
+	// Backoff, if set, replaces InitialBackoff, MaxBackoff and Jitter to decide
+	// the delay before every reconnect attempt.
+	Backoff Backoff
+
+	// OnReconnect, if set, is called after every reconnect attempt.
+	OnReconnect func(event ReconnectEvent)
+}
+
+// ReconnectEvent describes the outcome of a single reconnect attempt.
+type ReconnectEvent struct {
+	Attempt int   // The attempt number, starting at 1 for every lost connection
+	Err     error // Nil if the attempt succeeded
+}
+
+// WithReconnect enables automatic reconnection. When the connection to the server
+// is lost, the ClientConn dials the server again using the provided policy, obtains
+// a new client ID and re-registers the service passed to ServeClientService. Every
+// attempt tries all targets passed to DialTargets.
+func WithReconnect(policy ReconnectPolicy) DialOption {
+	return func(c *ClientConn) {
+		c.reconnect = &policy
+	}
+}
+
+func (p *ReconnectPolicy) backoff(attempt int) time.Duration {
+	if p.Backoff != nil {
+		return p.Backoff.NextInterval(attempt)
+	}
+	return ExponentialBackoff{Initial: p.InitialBackoff, Max: p.MaxBackoff, Jitter: p.Jitter}.NextInterval(attempt)
+}
+
+// supervise waits for the current connection to be lost and then reconnects,
+// until either the ClientConn is closed or the policy's attempts are exhausted.
+func (c *ClientConn) supervise() {
+	for {
+		c.mu.RLock()
+		conn, target := c.conn, c.target
+		c.mu.RUnlock()
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-conn.Context().Done():
+		}
+		c.Logger.Warn("connection lost, reconnecting", "target", target, "error", context.Cause(conn.Context()))
+		c.targets.failed(target, time.Now())
+		c.setStatus(ConnStatusReconnecting)
+		if err := c.redial(); err != nil {
+			if c.ctx.Err() != nil {
+				// Closed with Close, which terminates the ClientConn itself
+				return
+			}
+			c.Logger.Error("giving up reconnecting", "target", target, "error", err)
+			// Nothing else will ever use this ClientConn, make sure anyone
+			// waiting on it (like ServeClientService) returns.
+			c.terminate(fmt.Errorf("giving up reconnecting: %w", err))
+			c.cancel()
+			return
+		}
+	}
+}
+
+// redial attempts to re-establish the connection according to the reconnect
+// policy, and returns the error of the last attempt if none succeeded.
+func (c *ClientConn) redial() (err error) {
+	policy := c.reconnect
+	for attempt := 1; policy.MaxAttempts <= 0 || attempt <= policy.MaxAttempts; attempt++ {
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-c.ctx.Done():
+			timer.Stop()
+			return c.ctx.Err()
+		case <-timer.C:
+		}
+		err = c.connectTargets(c.ctx)
+		if policy.OnReconnect != nil {
+			policy.OnReconnect(ReconnectEvent{Attempt: attempt, Err: err})
+		}
+		if err == nil {
+			return nil
+		}
+		c.Logger.Warn("reconnect attempt failed", "attempt", attempt, "error", err)
+		if c.ctx.Err() != nil {
+			return c.ctx.Err()
+		}
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package brpc
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"slices"
+	"time"
+)
+
+const (
+	defaultRetryAttempts = 3
+	defaultRetryBackoff  = 100 * time.Millisecond
+)
+
+// RetryPolicy controls which failed client->server unary RPCs a ClientConn
+// retries, see WithRetry. Only idempotent methods should be retried, since a
+// call that failed may still have been executed by the server.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a call is attempted, including the first
+	// attempt. Defaults to 3.
+	MaxAttempts int
+
+	// Codes are the status codes that are retried. Defaults to
+	// codes.Unavailable, which is what calls fail with when the connection
+	// drops.
+	Codes []codes.Code
+
+	// IdempotentMethods lists the full names of the methods that may be
+	// retried, such as "/example.Greeter/Greet".
+	IdempotentMethods []string
+
+	// RetryAllMethods retries every method, including ones that aren't
+	// idempotent. Use with care.
+	RetryAllMethods bool
+
+	// Backoff decides the delay before retrying a call that failed while the
+	// connection was still up. Calls that failed because the connection was
+	// lost are retried as soon as the ClientConn reconnected, see
+	// WithReconnect. Defaults to a ConstantBackoff of 100ms.
+	Backoff Backoff
+}
+
+// WithRetry retries failed client->server unary RPCs according to policy. When
+// combined with WithReconnect, a call that fails because the connection dropped
+// is retried on the new connection once the ClientConn reconnected. Streaming
+// RPCs and server->client RPCs aren't retried.
+func WithRetry(policy RetryPolicy) DialOption {
+	return func(c *ClientConn) {
+		c.retry = &policy
+	}
+}
+
+// retries reports whether calls to method may be retried.
+func (p *RetryPolicy) retries(method string) bool {
+	return p.RetryAllMethods || slices.Contains(p.IdempotentMethods, method)
+}
+
+// retryable reports whether a call that failed with err may be retried.
+func (p *RetryPolicy) retryable(err error) bool {
+	code := status.Code(err)
+	if len(p.Codes) == 0 {
+		return code == codes.Unavailable
+	}
+	return slices.Contains(p.Codes, code)
+}
+
+func (p *RetryPolicy) attempts() int {
+	if p.MaxAttempts <= 0 {
+		return defaultRetryAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	if p.Backoff == nil {
+		return defaultRetryBackoff
+	}
+	return p.Backoff.NextInterval(attempt)
+}
+
+// invokeWithRetry invokes method on the current client->server connection, and
+// retries it according to the retry policy.
+func (c *ClientConn) invokeWithRetry(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	policy := c.retry
+	for attempt := 1; ; attempt++ {
+		c.mu.RLock()
+		conn, grpcConn, changed := c.conn, c.ClientConn, c.connChanged
+		c.mu.RUnlock()
+		err := grpcConn.Invoke(ctx, method, args, reply, opts...)
+		if err == nil || attempt >= policy.attempts() || !policy.retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		c.Logger.Debug("retrying call", "method", method, "attempt", attempt, "error", err)
+		if !c.awaitRetry(ctx, attempt, conn, changed) {
+			return err
+		}
+	}
+}
+
+// awaitRetry waits until a call whose attempt failed on conn can be retried:
+// after the backoff if conn is still up, or once the ClientConn replaced conn,
+// which is signalled by closing changed, if conn was lost. Returns false if ctx
+// is done or the ClientConn is closed for good first.
+func (c *ClientConn) awaitRetry(ctx context.Context, attempt int, conn Conn, changed <-chan struct{}) bool {
+	timer := time.NewTimer(c.retry.backoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+		return false
+	case <-c.done:
+		return false
+	}
+	if conn.Context().Err() == nil {
+		return true
+	}
+	select {
+	case <-changed:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-c.done:
+		return false
+	}
+}
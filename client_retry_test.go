@@ -0,0 +1,91 @@
+package brpc_test
+
+import (
+	"context"
+	"github.com/clarkmcc/brpc"
+	"github.com/clarkmcc/brpc/internal/example"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyGreeter fails the first failures calls to Greet with code.
+type flakyGreeter struct {
+	example.UnimplementedGreeterServer
+	failures int64
+	code     codes.Code
+	calls    atomic.Int64
+}
+
+func (g *flakyGreeter) Greet(context.Context, *example.GreetRequest) (*example.GreetResponse, error) {
+	if g.calls.Add(1) <= g.failures {
+		return nil, status.Error(g.code, "flaky")
+	}
+	return &example.GreetResponse{Greeting: "Hello"}, nil
+}
+
+func TestRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		failures  int64
+		code      codes.Code
+		methods   []string
+		wantCode  codes.Code
+		wantCalls int64
+	}{
+		{
+			name:      "succeeds after failures",
+			failures:  2,
+			code:      codes.Unavailable,
+			methods:   []string{"/Greeter/Greet"},
+			wantCode:  codes.OK,
+			wantCalls: 3,
+		},
+		{
+			name:      "gives up after max attempts",
+			failures:  10,
+			code:      codes.Unavailable,
+			methods:   []string{"/Greeter/Greet"},
+			wantCode:  codes.Unavailable,
+			wantCalls: 4,
+		},
+		{
+			name:      "non-retryable code",
+			failures:  2,
+			code:      codes.InvalidArgument,
+			methods:   []string{"/Greeter/Greet"},
+			wantCode:  codes.InvalidArgument,
+			wantCalls: 1,
+		},
+		{
+			name:      "non-idempotent method",
+			failures:  2,
+			code:      codes.Unavailable,
+			wantCode:  codes.Unavailable,
+			wantCalls: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			greeter := &flakyGreeter{failures: tc.failures, code: tc.code}
+			server := brpc.NewServer(brpc.ServerConfig[any]{})
+			example.RegisterGreeterServer(server.Server, greeter)
+			conn := dial(t, startServer(t, server), brpc.WithRetry(brpc.RetryPolicy{
+				MaxAttempts:       4,
+				IdempotentMethods: tc.methods,
+				Backoff:           brpc.ConstantBackoff{Interval: time.Millisecond},
+			}))
+
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			_, err := example.NewGreeterClient(conn).Greet(ctx, &example.GreetRequest{})
+			if status.Code(err) != tc.wantCode {
+				t.Errorf("got %v, want %v", err, tc.wantCode)
+			}
+			if calls := greeter.calls.Load(); calls != tc.wantCalls {
+				t.Errorf("got %d attempts, want %d", calls, tc.wantCalls)
+			}
+		})
+	}
+}
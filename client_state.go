@@ -0,0 +1,109 @@
+package brpc
+
+import (
+	"github.com/google/uuid"
+	"net"
+)
+
+// ConnStatus is the lifecycle stage of a ClientConn, see ClientConn.State.
+type ConnStatus int32
+
+const (
+	// ConnStatusConnecting is the status while the ClientConn is dialing the
+	// server for the first time.
+	ConnStatusConnecting ConnStatus = iota
+	// ConnStatusConnected is the status while the ClientConn has a connection to
+	// the server.
+	ConnStatusConnected
+	// ConnStatusReconnecting is the status after the connection was lost, while
+	// the ClientConn is trying to reconnect, see WithReconnect.
+	ConnStatusReconnecting
+	// ConnStatusClosed is the final status, once the ClientConn was closed, the
+	// connection was lost without reconnection enabled, or reconnecting gave up.
+	ConnStatusClosed
+)
+
+func (s ConnStatus) String() string {
+	switch s {
+	case ConnStatusConnecting:
+		return "connecting"
+	case ConnStatusConnected:
+		return "connected"
+	case ConnStatusReconnecting:
+		return "reconnecting"
+	case ConnStatusClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnState is a snapshot of the state of a ClientConn.
+type ConnState struct {
+	Status ConnStatus
+	// ID is the client ID assigned by the server on the most recent connection,
+	// uuid.Nil if the ClientConn never connected.
+	ID uuid.UUID
+	// Target and RemoteAddr identify the server of the most recent connection,
+	// they are empty if the ClientConn never connected.
+	Target     string
+	RemoteAddr net.Addr
+}
+
+// State returns the current state of the ClientConn, for example to show the
+// connection status in a UI or to gate features on being connected.
+func (c *ClientConn) State() ConnState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	state := ConnState{
+		Status: ConnStatus(c.status.Load()),
+		ID:     c.uuid,
+		Target: c.target,
+	}
+	if c.conn != nil {
+		state.RemoteAddr = c.conn.RemoteAddr()
+	}
+	return state
+}
+
+// Done returns a channel that is closed once the ClientConn is closed for good:
+// when Close was called, the connection was lost without reconnection enabled,
+// or reconnecting gave up. Err reports why.
+func (c *ClientConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns nil while Done isn't closed yet. Afterwards, it returns nil if the
+// ClientConn was closed with Close, and otherwise the error that ended it.
+func (c *ClientConn) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// terminate closes the ClientConn for good with err, see Done. Only the first
+// call has an effect.
+func (c *ClientConn) terminate(err error) {
+	c.setStatus(ConnStatusClosed)
+	c.doneOnce.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+// setStatus moves the ClientConn to status, unless it is already closed, which
+// is final.
+func (c *ClientConn) setStatus(status ConnStatus) {
+	for {
+		current := c.status.Load()
+		if ConnStatus(current) == ConnStatusClosed {
+			return
+		}
+		if c.status.CompareAndSwap(current, int32(status)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package brpc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"go.uber.org/multierr"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultTargetCooldown = 30 * time.Second
+
+// FailoverPolicy controls which of the targets passed to DialTargets a
+// ClientConn connects to, see WithFailover.
+type FailoverPolicy struct {
+	// RoundRobin spreads connections across the healthy targets by starting with
+	// the target after the one that was connected last. By default, targets are
+	// tried in the order they were passed to DialTargets, so the first healthy
+	// target acts as the primary.
+	RoundRobin bool
+
+	// Cooldown is how long a target is considered unhealthy after dialing it
+	// failed or its connection was lost. Unhealthy targets are only tried once all
+	// healthy ones failed, the ones that failed longest ago first. Defaults to 30s.
+	Cooldown time.Duration
+}
+
+// WithFailover sets the policy that selects a target when the ClientConn
+// connects or reconnects. It only has an effect on ClientConns created with
+// DialTargets.
+func WithFailover(policy FailoverPolicy) DialOption {
+	return func(c *ClientConn) {
+		c.failover = policy
+	}
+}
+
+// DialTargets is like DialContext, but connects to the first of several brpc
+// servers that accepts the connection, according to the FailoverPolicy set with
+// WithFailover. Reconnection is enabled with the default ReconnectPolicy unless
+// WithReconnect is passed, so when the connection is lost, the ClientConn fails
+// over to another healthy target. The ClientConn stays connected to a target
+// until its connection is lost, Target reports which one that is.
+//
+// Every target must serve the same services, since a reconnected client is
+// assigned a new ID by the server it lands on.
+func DialTargets(ctx context.Context, targets []string, config *tls.Config, opts ...DialOption) (*ClientConn, error) {
+	if len(targets) == 0 {
+		return nil, ErrNoTargets
+	}
+	return dialTargets(ctx, targets, config, append([]DialOption{WithReconnect(ReconnectPolicy{})}, opts...))
+}
+
+// Target returns the target that the current connection was dialed to.
+func (c *ClientConn) Target() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.target
+}
+
+// connectTargets connects to the first candidate target that accepts the
+// connection, recording the outcome of every attempt in the target set. If all
+// of them fail, the errors are combined.
+func (c *ClientConn) connectTargets(ctx context.Context) error {
+	var errs error
+	candidates := c.targets.candidates(time.Now())
+	for _, target := range candidates {
+		err := c.connect(ctx, target)
+		if err == nil {
+			c.targets.succeeded(target)
+			return nil
+		}
+		c.targets.failed(target, time.Now())
+		if len(candidates) > 1 {
+			err = fmt.Errorf("%v: %w", target, err)
+		}
+		errs = multierr.Append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return errs
+}
+
+// targetSet tracks the health of the targets that a ClientConn may connect to.
+type targetSet struct {
+	mu       sync.Mutex
+	targets  []*targetHealth
+	policy   FailoverPolicy
+	previous int // Index of the target that was connected last
+}
+
+// targetHealth records the failures of a single target.
+type targetHealth struct {
+	target   string
+	failures int       // Consecutive failures, reset once a connection succeeds
+	failedAt time.Time // When the last failure happened
+}
+
+func newTargetSet(targets []string, policy FailoverPolicy) *targetSet {
+	if policy.Cooldown <= 0 {
+		policy.Cooldown = defaultTargetCooldown
+	}
+	s := &targetSet{policy: policy, previous: -1}
+	for _, target := range targets {
+		s.targets = append(s.targets, &targetHealth{target: target})
+	}
+	return s
+}
+
+// candidates returns all targets in the order they should be tried: healthy
+// targets according to the policy, followed by unhealthy targets with the ones
+// that failed longest ago first.
+func (s *targetSet) candidates(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := 0
+	if s.policy.RoundRobin {
+		start = s.previous + 1
+	}
+	var healthy []string
+	var unhealthy []*targetHealth
+	for i := range s.targets {
+		t := s.targets[(start+i)%len(s.targets)]
+		if t.failures == 0 || now.Sub(t.failedAt) >= s.policy.Cooldown {
+			healthy = append(healthy, t.target)
+		} else {
+			unhealthy = append(unhealthy, t)
+		}
+	}
+	sort.SliceStable(unhealthy, func(i, j int) bool {
+		return unhealthy[i].failedAt.Before(unhealthy[j].failedAt)
+	})
+	for _, t := range unhealthy {
+		healthy = append(healthy, t.target)
+	}
+	return healthy
+}
+
+// succeeded marks target as healthy and remembers it as the one connected last.
+func (s *targetSet) succeeded(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.targets {
+		if t.target == target {
+			t.failures = 0
+			s.previous = i
+		}
+	}
+}
+
+// failed marks target as unhealthy as of now.
+func (s *targetSet) failed(target string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.targets {
+		if t.target == target {
+			t.failures++
+			t.failedAt = now
+		}
+	}
+}
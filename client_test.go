@@ -0,0 +1,163 @@
+package brpc_test
+
+import (
+	"context"
+	"errors"
+	"github.com/clarkmcc/brpc"
+	"github.com/clarkmcc/brpc/brpctest"
+	"github.com/clarkmcc/brpc/internal/example"
+	"google.golang.org/grpc"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds how long tests wait for something that should happen promptly.
+const testTimeout = 5 * time.Second
+
+// startServer serves server on an in-memory listener until the test finishes.
+func startServer[C any](t *testing.T, server *brpc.Server[C]) *brpctest.Listener {
+	t.Helper()
+	listener := brpctest.NewListener()
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		_ = server.ServeListener(context.Background(), listener)
+	}()
+	t.Cleanup(func() {
+		server.Stop()
+		<-served
+	})
+	return listener
+}
+
+// dial connects a client to listener and closes it when the test finishes.
+func dial(t *testing.T, listener *brpctest.Listener, opts ...brpc.DialOption) *brpc.ClientConn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	conn, err := brpc.DialContext(ctx, "pipe", nil, append(opts, brpc.WithTransport(listener.Transport()))...)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// waitForGoroutines waits until no more than n goroutines are running, failing
+// the test if they don't finish in time.
+func waitForGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines are running, want at most %d:\n%s", runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialCancelledDuringHandshake(t *testing.T) {
+	// The listener accepts connections but never answers the handshake.
+	listener := brpctest.NewListener()
+	defer listener.Close()
+	accepted := make(chan brpc.Conn, 1)
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := brpc.DialContext(ctx, "pipe", nil, brpc.WithTransport(listener.Transport()))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dialing returned %v after it was cancelled", elapsed)
+	}
+
+	// Dialing closed the half-open connection, which ends the peer's side too.
+	select {
+	case conn := <-accepted:
+		select {
+		case <-conn.Context().Done():
+		case <-time.After(testTimeout):
+			t.Fatal("the connection wasn't closed after dialing was cancelled")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the connection wasn't accepted")
+	}
+	waitForGoroutines(t, baseline)
+}
+
+func TestServeClientServiceReturnsOnShutdown(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []brpc.DialOption
+	}{
+		{name: "without reconnect"},
+		{name: "with reconnect", opts: []brpc.DialOption{brpc.WithReconnect(brpc.ReconnectPolicy{})}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := brpc.NewServer(brpc.ServerConfig[example.NamerClient]{ClientServiceBuilder: example.NewNamerClient})
+			conn := dial(t, startServer(t, server), tc.opts...)
+
+			shutdown := make(chan struct{})
+			served := make(chan error, 1)
+			go func() {
+				served <- brpc.ServeClientService[example.NamerServer](shutdown, conn, func(registrar grpc.ServiceRegistrar) {
+					example.RegisterNamerServer(registrar, &example.UnimplementedNamerServer{})
+				})
+			}()
+			time.Sleep(50 * time.Millisecond)
+			close(shutdown)
+			select {
+			case err := <-served:
+				if err != nil {
+					t.Fatalf("serving: %v", err)
+				}
+			case <-time.After(testTimeout):
+				t.Fatal("ServeClientService didn't return after shutdown was closed")
+			}
+		})
+	}
+}
+
+func TestServeClientServiceAlreadyShutDown(t *testing.T) {
+	server := brpc.NewServer(brpc.ServerConfig[example.NamerClient]{ClientServiceBuilder: example.NewNamerClient})
+	conn := dial(t, startServer(t, server), brpc.WithReconnect(brpc.ReconnectPolicy{}))
+
+	shutdown := make(chan struct{})
+	close(shutdown)
+	served := make(chan error, 1)
+	go func() {
+		served <- brpc.ServeClientService[example.NamerServer](shutdown, conn, func(registrar grpc.ServiceRegistrar) {
+			example.RegisterNamerServer(registrar, &example.UnimplementedNamerServer{})
+		})
+	}()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("serving: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("ServeClientService didn't return although shutdown was closed")
+	}
+}
+
+func TestNilClientLoggerFallsBackToDefault(t *testing.T) {
+	listener := startServer(t, brpc.NewServer(brpc.ServerConfig[any]{}))
+	conn := dial(t, listener, brpc.WithClientLogger(nil))
+	if conn.Logger == nil {
+		t.Fatal("logger is nil")
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("closing: %v", err)
+	}
+}
@@ -3,10 +3,12 @@ package main
 import (
 	context "context"
 	"crypto/tls"
+	"flag"
 	"fmt"
 	"github.com/clarkmcc/brpc"
 	"github.com/clarkmcc/brpc/internal/example"
 	"google.golang.org/grpc"
+	"io"
 )
 
 func main() {
@@ -16,17 +18,22 @@ func main() {
 }
 
 func run() error {
-	conn, err := brpc.Dial("127.0.0.1:10000", &tls.Config{})
+	tcp := flag.Bool("tcp", false, "connect over yamux on TCP instead of QUIC")
+	flag.Parse()
+
+	var opts []brpc.DialOption
+	if *tcp {
+		opts = append(opts, brpc.WithTransport(brpc.YamuxTransport{}))
+	}
+	conn, err := brpc.Dial("127.0.0.1:10000", &tls.Config{}, opts...)
 	if err != nil {
 		return err
 	}
+	serveErr := make(chan error, 1)
 	go func() {
-		err = brpc.ServeClientService[example.NamerServer](make(chan struct{}), conn, func(registrar grpc.ServiceRegistrar) {
+		serveErr <- brpc.ServeClientService[example.NamerServer](make(chan struct{}), conn, func(registrar grpc.ServiceRegistrar) {
 			example.RegisterNamerServer(registrar, &service{})
 		})
-		if err != nil {
-			panic(err)
-		}
 	}()
 
 	client := example.NewGreeterClient(conn)
@@ -38,13 +45,69 @@ func run() error {
 		return err
 	}
 	fmt.Printf("Got greeting: %v\n", res.GetGreeting())
+	res, err = client.GreetAll(context.Background(), &example.GreetRequest{})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Got greeting: %v\n", res.GetGreeting())
+	err = greetStream(client)
+	if err != nil {
+		return err
+	}
+	err = greetEach(client)
+	if err != nil {
+		return err
+	}
 	err = conn.Close()
 	if err != nil {
 		return fmt.Errorf("closing: %v", err)
 	}
+	err = <-serveErr
+	if err != nil {
+		return fmt.Errorf("serving client service: %v", err)
+	}
 	return nil
 }
 
+// greetStream receives the greetings that the server streams for the names that
+// it asks for over Namer.NameEach.
+func greetStream(client example.GreeterClient) error {
+	stream, err := client.GreetStream(context.Background(), &example.GreetRequest{})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Got streamed greeting: %v\n", res.GetGreeting())
+	}
+}
+
+// greetEach streams names to the server and receives a greeting for each of them.
+func greetEach(client example.GreeterClient) error {
+	stream, err := client.GreetEach(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"brpc", "grpc", "quic"} {
+		err = stream.Send(&example.NameResponse{Name: name})
+		if err != nil {
+			return err
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Got greeting for %v: %v\n", name, res.GetGreeting())
+	}
+	return stream.CloseSend()
+}
+
 type service struct {
 	example.UnimplementedNamerServer
 }
@@ -52,3 +115,30 @@ type service struct {
 func (s *service) Name(_ context.Context, _ *example.NameRequest) (*example.NameResponse, error) {
 	return &example.NameResponse{Name: "brpc"}, nil
 }
+
+func (s *service) Names(_ *example.NameRequest, stream example.Namer_NamesServer) error {
+	for _, name := range []string{"brpc", "grpc", "quic"} {
+		err := stream.Send(&example.NameResponse{Name: name})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *service) NameEach(stream example.Namer_NameEachServer) error {
+	names := []string{"brpc", "grpc", "quic"}
+	for i := 0; ; i++ {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = stream.Send(&example.NameResponse{Name: names[i%len(names)]})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -2,11 +2,12 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"github.com/clarkmcc/brpc"
 	"github.com/clarkmcc/brpc/internal/example"
-	"github.com/quic-go/quic-go"
-	"google.golang.org/grpc"
+	"io"
+	"strings"
 )
 
 func main() {
@@ -16,21 +17,27 @@ func main() {
 }
 
 func run() error {
-	// Create a quic listener
-	l, err := quic.ListenAddr(":10000", example.TLSConfig(), nil)
+	tcp := flag.Bool("tcp", false, "serve over yamux on TCP instead of QUIC")
+	flag.Parse()
+
+	// Create a quic listener, or a TCP listener that multiplexes with yamux
+	var transport brpc.Transport = brpc.QUICTransport{}
+	if *tcp {
+		transport = brpc.YamuxTransport{}
+	}
+	l, err := transport.Listen(":10000", example.TLSConfig())
 	if err != nil {
 		return err
 	}
 
-	// Create the gRPC server, the bRPC server, and register our gRPC service
-	srv := grpc.NewServer()
+	// Create the bRPC server, which builds the gRPC server, and register our
+	// gRPC service
 	server := brpc.NewServer(brpc.ServerConfig[example.NamerClient]{
 		ClientServiceBuilder: example.NewNamerClient,
-		Server:               srv,
 	})
-	example.RegisterGreeterServer(srv, &GreeterService{Server: server})
+	example.RegisterGreeterServer(server.Server, &GreeterService{Server: server})
 
-	return server.Serve(context.Background(), l)
+	return server.ServeListener(context.Background(), l)
 }
 
 type GreeterService struct {
@@ -38,6 +45,11 @@ type GreeterService struct {
 	*brpc.Server[example.NamerClient]
 }
 
+// Greet asks the calling client for its name. The handler's ctx identifies the
+// caller, since the client's interceptors send its id in the request metadata
+// and the server's interceptors resolve it before the handler runs, so it must
+// be passed to ClientFromContext as is. Passing it on to the callback also
+// bounds the callback by the caller's deadline.
 func (s *GreeterService) Greet(ctx context.Context, _ *example.GreetRequest) (*example.GreetResponse, error) {
 	client, err := s.ClientFromContext(ctx)
 	if err != nil {
@@ -51,3 +63,74 @@ func (s *GreeterService) Greet(ctx context.Context, _ *example.GreetRequest) (*e
 		Greeting: fmt.Sprintf("Hello %v", res.GetName()),
 	}, nil
 }
+
+func (s *GreeterService) GreetAll(ctx context.Context, _ *example.GreetRequest) (*example.GreetResponse, error) {
+	client, err := s.ClientFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := client.Names(ctx, &example.NameRequest{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, res.GetName())
+	}
+	return &example.GreetResponse{
+		Greeting: fmt.Sprintf("Hello %v", strings.Join(names, ", ")),
+	}, nil
+}
+
+func (s *GreeterService) GreetStream(_ *example.GreetRequest, stream example.Greeter_GreetStreamServer) error {
+	client, err := s.ClientFromContext(stream.Context())
+	if err != nil {
+		return err
+	}
+	names, err := client.NameEach(stream.Context())
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		err = names.Send(&example.NameRequest{})
+		if err != nil {
+			return err
+		}
+		res, err := names.Recv()
+		if err != nil {
+			return err
+		}
+		err = stream.Send(&example.GreetResponse{
+			Greeting: fmt.Sprintf("Hello %v", res.GetName()),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return names.CloseSend()
+}
+
+func (s *GreeterService) GreetEach(stream example.Greeter_GreetEachServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = stream.Send(&example.GreetResponse{
+			Greeting: fmt.Sprintf("Hello %v", req.GetName()),
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"github.com/clarkmcc/brpc"
+	"github.com/clarkmcc/brpc/brpctest"
+	"github.com/clarkmcc/brpc/internal/example"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"io"
+	"testing"
+	"time"
+)
+
+// checkingGreeter checks that every call carries the id of the calling client
+// before the example's GreeterService handles it.
+type checkingGreeter struct {
+	*GreeterService
+	t *testing.T
+}
+
+func (g checkingGreeter) Greet(ctx context.Context, req *example.GreetRequest) (*example.GreetResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ids := md.Get(brpc.DefaultClientIDMetadataKey); len(ids) != 1 {
+		g.t.Errorf("got client ids %v in the incoming metadata, want one", ids)
+	}
+	return g.GreeterService.Greet(ctx, req)
+}
+
+// namer is the service that the example client serves.
+type namer struct {
+	example.UnimplementedNamerServer
+}
+
+func (namer) Name(context.Context, *example.NameRequest) (*example.NameResponse, error) {
+	return &example.NameResponse{Name: "brpc"}, nil
+}
+
+func (namer) Names(_ *example.NameRequest, stream example.Namer_NamesServer) error {
+	for _, name := range []string{"brpc", "grpc"} {
+		if err := stream.Send(&example.NameResponse{Name: name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (namer) NameEach(stream example.Namer_NameEachServer) error {
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&example.NameResponse{Name: "brpc"}); err != nil {
+			return err
+		}
+	}
+}
+
+func TestGreeterService(t *testing.T) {
+	h := brpctest.NewHarness(t, brpctest.HarnessConfig[example.NamerClient]{
+		Server: brpc.ServerConfig[example.NamerClient]{ClientServiceBuilder: example.NewNamerClient},
+		RegisterServer: func(server *brpc.Server[example.NamerClient], registrar grpc.ServiceRegistrar) {
+			example.RegisterGreeterServer(registrar, checkingGreeter{GreeterService: &GreeterService{Server: server}, t: t})
+		},
+		RegisterClient: func(registrar grpc.ServiceRegistrar) {
+			example.RegisterNamerServer(registrar, namer{})
+		},
+	})
+	client := example.NewGreeterClient(h.Client)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.Greet(ctx, &example.GreetRequest{})
+	if err != nil {
+		t.Fatalf("Greet: %v", err)
+	}
+	if got, want := res.GetGreeting(), "Hello brpc"; got != want {
+		t.Errorf("Greet = %q, want %q", got, want)
+	}
+
+	res, err = client.GreetAll(ctx, &example.GreetRequest{})
+	if err != nil {
+		t.Fatalf("GreetAll: %v", err)
+	}
+	if got, want := res.GetGreeting(), "Hello brpc, grpc"; got != want {
+		t.Errorf("GreetAll = %q, want %q", got, want)
+	}
+
+	stream, err := client.GreetStream(ctx, &example.GreetRequest{})
+	if err != nil {
+		t.Fatalf("GreetStream: %v", err)
+	}
+	var greetings int
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("receiving greeting: %v", err)
+		}
+		if got, want := res.GetGreeting(), "Hello brpc"; got != want {
+			t.Errorf("GreetStream sent %q, want %q", got, want)
+		}
+		greetings++
+	}
+	if greetings != 3 {
+		t.Errorf("GreetStream sent %d greetings, want 3", greetings)
+	}
+}
@@ -0,0 +1,27 @@
+package brpc
+
+import (
+	"google.golang.org/grpc"
+	_ "google.golang.org/grpc/encoding/gzip" // Registers the gzip compressor
+)
+
+// WithDefaultCompression compresses all client->server RPCs with the named
+// compressor, for example "gzip", unless a call overrides it with
+// grpc.UseCompressor. The compressor must be registered with the
+// google.golang.org/grpc/encoding package, gzip is always registered. Responses
+// from the server, and the client's responses to server->client RPCs, are
+// compressed with whatever the request used.
+func WithDefaultCompression(name string) DialOption {
+	return func(c *ClientConn) {
+		c.compression = name
+	}
+}
+
+// compressionDialOptions returns the dial options that make every call on a
+// connection use the named compressor, none if name is empty.
+func compressionDialOptions(name string) []grpc.DialOption {
+	if name == "" {
+		return nil
+	}
+	return []grpc.DialOption{grpc.WithDefaultCallOptions(grpc.UseCompressor(name))}
+}
@@ -0,0 +1,140 @@
+package brpc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"go.uber.org/multierr"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Once the handshake is complete, both sides accept unidirectional streams from
+// the peer as control streams. Each control stream carries a single frame, made
+// of a frame type byte followed by a payload of a fixed size per type.
+const (
+	controlPing byte = 1 // Payload is an 8 byte ping id, answered with a pong
+	controlPong byte = 2 // Payload is the 8 byte id of the ping being answered
+)
+
+// controlFrameSize is the size of a control frame including the type byte.
+const controlFrameSize = 1 + 8
+
+// controlTimeout bounds how long a peer may take to send a control frame after
+// opening its stream, and how long answering a frame may take.
+const controlTimeout = 10 * time.Second
+
+// pinger tracks the pings sent over a connection that are waiting for a pong.
+type pinger struct {
+	mu      sync.Mutex
+	next    uint64
+	waiters map[uint64]chan struct{}
+}
+
+func newPinger() *pinger {
+	return &pinger{waiters: make(map[uint64]chan struct{})}
+}
+
+// ping sends a ping over conn and waits for the peer to answer it with a pong on
+// a stream that the peer opens, so both directions of the connection are known
+// to work once it returns nil. It returns early if ctx is done or conn is closed.
+func (p *pinger) ping(ctx context.Context, conn Conn) error {
+	p.mu.Lock()
+	p.next++
+	id := p.next
+	pong := make(chan struct{})
+	p.waiters[id] = pong
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.waiters, id)
+		p.mu.Unlock()
+	}()
+
+	if err := sendControlFrame(ctx, conn, controlPing, id); err != nil {
+		return fmt.Errorf("sending ping: %w", err)
+	}
+	select {
+	case <-pong:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-conn.Context().Done():
+		return fmt.Errorf("connection closed: %w", context.Cause(conn.Context()))
+	}
+}
+
+// pong wakes up the ping with the provided id, if it is still waiting.
+func (p *pinger) pong(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pong, ok := p.waiters[id]; ok {
+		close(pong)
+		delete(p.waiters, id)
+	}
+}
+
+// sendControlFrame opens a unidirectional stream to the peer and writes a single
+// control frame to it.
+func sendControlFrame(ctx context.Context, conn Conn, frameType byte, payload uint64) (err error) {
+	stream, err := conn.OpenUniStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer multierr.AppendFunc(&err, stream.Close)
+	defer interruptOnDone(ctx, stream.SetWriteDeadline)()
+	var frame [controlFrameSize]byte
+	frame[0] = frameType
+	binary.BigEndian.PutUint64(frame[1:], payload)
+	_, err = stream.Write(frame[:])
+	return err
+}
+
+// serveControl accepts control streams from the peer until conn is closed,
+// answering pings and passing pongs to pings, which may be nil if this side
+// doesn't send pings.
+func serveControl(conn Conn, pings *pinger, logger *slog.Logger) {
+	for {
+		stream, err := conn.AcceptUniStream(conn.Context())
+		if err != nil {
+			return
+		}
+		go func() {
+			frameType, payload, err := readControlFrame(stream)
+			if err != nil {
+				logger.Debug("reading control frame", "error", err)
+				return
+			}
+			switch frameType {
+			case controlPing:
+				ctx, cancel := context.WithTimeout(conn.Context(), controlTimeout)
+				defer cancel()
+				if err := sendControlFrame(ctx, conn, controlPong, payload); err != nil {
+					logger.Debug("answering ping", "error", err)
+				}
+			case controlPong:
+				if pings != nil {
+					pings.pong(payload)
+				}
+			default:
+				logger.Debug("ignoring unknown control frame", "type", frameType)
+			}
+		}()
+	}
+}
+
+// readControlFrame reads the single frame of a control stream, up to the end of
+// the stream so that the stream is released.
+func readControlFrame(stream ReceiveStream) (frameType byte, payload uint64, err error) {
+	_ = stream.SetReadDeadline(time.Now().Add(controlTimeout))
+	frame, err := io.ReadAll(io.LimitReader(stream, controlFrameSize+1))
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(frame) != controlFrameSize {
+		return 0, 0, fmt.Errorf("read %v bytes, expected %v", len(frame), controlFrameSize)
+	}
+	return frame[0], binary.BigEndian.Uint64(frame[1:]), nil
+}
@@ -1,21 +1,260 @@
 package brpc
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"github.com/quic-go/quic-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+)
 
 var (
 	ErrClientNotConnected = errors.New("client not connected")
+	ErrForcedShutdown     = errors.New("server did not drain before deadline, forced stop")
+	// ErrForcedClose is returned by ClientConn.CloseContext when in-flight
+	// server->client RPCs didn't finish before the context was done.
+	ErrForcedClose = errors.New("callback server did not drain before deadline, forced stop")
+	// ErrAlreadyServing is returned by ServeClientService when it was already
+	// called for the ClientConn.
+	ErrAlreadyServing = errors.New("client service is already being served")
+	// ErrCallbackDisabled is returned by ServeClientService when the ClientConn
+	// was dialed WithoutCallback, and by Server.ClientFromContext and friends when
+	// the server was created without a ClientServiceBuilder and no client
+	// services were registered with RegisterClientService.
+	ErrCallbackDisabled = errors.New("server->client calls are disabled for this connection")
+	// ErrClientHasNoCallbackService is returned by Server.ClientFromContext and
+	// friends when the client didn't advertise CapabilityCallback during the
+	// handshake, because it was dialed WithoutCallback.
+	ErrClientHasNoCallbackService = errors.New("client does not serve server->client calls")
+	// ErrClientServiceNotRegistered is returned by ClientServiceFromContext when
+	// no builder for the requested stub was registered with RegisterClientService.
+	ErrClientServiceNotRegistered = errors.New("client service not registered")
+	// ErrCallbackUnavailable is returned by Server.ClientFromContext and friends
+	// when the server->client connection couldn't be established, and the
+	// server was configured with ServerConfig.TolerateCallbackFailure.
+	ErrCallbackUnavailable = errors.New("server->client connection is unavailable")
+	// ErrStreamAlreadyDialed is returned when gRPC tries to reconnect over the
+	// stream that a gRPC connection was dedicated to, after the stream failed.
+	ErrStreamAlreadyDialed = errors.New("stream was already dialed")
+
+	// Returned by ClientFromContext and friends when the client id can't be read
+	// from the incoming RPC's metadata.
+	ErrMissingMetadata = errors.New("metadata not provided")
+	ErrMissingClientID = errors.New("client id not provided")
+	ErrInvalidClientID = errors.New("invalid client id")
+	// ErrMultipleClientIDs is returned when the metadata holds more than one client
+	// id, which could otherwise be used to smuggle in another client's id.
+	ErrMultipleClientIDs = errors.New("multiple client ids provided")
+	// ErrClientIDMismatch is returned when the client id in the metadata isn't the
+	// id that was assigned to the connection the RPC arrived on.
+	ErrClientIDMismatch = errors.New("client id does not belong to this connection")
+
+	// ErrProtocolVersionMismatch is returned during the handshake when the peer
+	// speaks a version of the brpc wire protocol that we don't support.
+	ErrProtocolVersionMismatch = errors.New("unsupported brpc protocol version")
+
+	// ErrDuplicateClientID is returned when a client is assigned an ID that belongs
+	// to another connected client and the server is configured to reject duplicates.
+	ErrDuplicateClientID = errors.New("client already exists")
+
+	// ErrServerDraining is reported to Stats.HandshakeFailed for connections
+	// that the server rejected with ReasonDraining because it was shutting down.
+	ErrServerDraining = errors.New("server is draining")
+
+	// ErrRawStreamsUnsupported is returned by ClientConn.OpenRawStream when the
+	// server has no ServerConfig.RawStreamHandler.
+	ErrRawStreamsUnsupported = errors.New("server does not accept raw streams")
+
+	// ErrALPNMismatch is returned when dialing fails because the client and
+	// server don't have a TLS ALPN protocol in common, see DefaultNextProto.
+	ErrALPNMismatch = errors.New("no common TLS ALPN protocol with the server")
+
+	// ErrAuthenticationFailed is returned by Dial when the server rejected the
+	// client's credentials, see ServerConfig.Authenticator.
+	ErrAuthenticationFailed = errors.New("authentication failed")
+
+	// ErrHandshakeTooLarge is returned when a handshake payload exceeds the
+	// maximum size of 64KB.
+	ErrHandshakeTooLarge = errors.New("handshake payload too large")
+
+	// ErrHandshakeTimeout is returned when the brpc handshake doesn't complete
+	// within the configured handshake timeout.
+	ErrHandshakeTimeout = errors.New("handshake timed out")
+
+	// ErrClientNotInjected is returned by ClientFromContextTyped when the RPC
+	// wasn't intercepted by a server with ServerConfig.InjectClient enabled.
+	ErrClientNotInjected = errors.New("client was not injected into the context")
+
+	// ErrTooManyStreams is returned to clients that exceed
+	// ServerConfig.MaxConcurrentStreamsPerClient.
+	ErrTooManyStreams = errors.New("too many concurrent streams")
+
+	// ErrTooManyConnections is reported to Stats.ConnRejected for connections
+	// that were rejected because the server reached ServerConfig.MaxConnections.
+	ErrTooManyConnections = errors.New("too many connections")
+	// ErrRateLimited is reported to Stats.ConnRejected for connections that were
+	// rejected because their IP exceeded ServerConfig.ConnectionRatePerIP.
+	ErrRateLimited = errors.New("connection rate limit exceeded")
+
+	// ErrNoTargets is returned by DialTargets when it is called without targets.
+	ErrNoTargets = errors.New("no targets to dial")
 )
 
+// statusError is an error carrying a gRPC status code that still unwraps to err,
+// so that callers can both match it with errors.Is and return it from an RPC
+// handler without losing the status code.
+type statusError struct {
+	code codes.Code
+	err  error
+}
+
+func newStatusError(code codes.Code, err error) error {
+	return &statusError{code: code, err: err}
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+func (e *statusError) GRPCStatus() *status.Status {
+	return status.New(e.code, e.err.Error())
+}
+
+// Reason describes why a brpc connection was closed. It is sent to the peer, as the
+// QUIC application error code or in a close notification for other transports, so
+// both ends can tell why a connection went away.
+type Reason quic.ApplicationErrorCode
+
+const (
+	ReasonNormal             Reason = 0   // The connection was closed without error
+	ReasonShutdown           Reason = 100 // The server is shutting down
+	ReasonAuthFailed         Reason = 101 // The peer could not be authenticated
+	ReasonProtocolMismatch   Reason = 102 // The peers don't speak the same brpc protocol version
+	ReasonIdleTimeout        Reason = 103 // The connection saw no RPCs within the idle timeout
+	ReasonInternal           Reason = 104 // The handshake or connection failed unexpectedly
+	ReasonDuplicateClientID  Reason = 105 // Another client with the same ID is already connected
+	ReasonReplaced           Reason = 106 // A newer connection with the same client ID replaced this one
+	ReasonTooManyConnections Reason = 107 // The server is at its connection limit
+	ReasonRateLimited        Reason = 108 // The peer's IP connected too often
+	ReasonHandshakeRejected  Reason = 109 // The server rejected the client's HandshakeInfo
+	ReasonDisconnected       Reason = 110 // The server disconnected the client, see Server.DisconnectClient
+	ReasonDraining           Reason = 111 // The server is shutting down and doesn't accept new clients, retry another instance
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonNormal:
+		return "normal"
+	case ReasonShutdown:
+		return "server shutdown"
+	case ReasonAuthFailed:
+		return "authentication failed"
+	case ReasonProtocolMismatch:
+		return "protocol mismatch"
+	case ReasonIdleTimeout:
+		return "idle timeout"
+	case ReasonInternal:
+		return "internal error"
+	case ReasonDuplicateClientID:
+		return "duplicate client id"
+	case ReasonReplaced:
+		return "replaced by a newer connection"
+	case ReasonTooManyConnections:
+		return "too many connections"
+	case ReasonRateLimited:
+		return "rate limited"
+	case ReasonHandshakeRejected:
+		return "handshake rejected"
+	case ReasonDisconnected:
+		return "disconnected by the server"
+	case ReasonDraining:
+		return "server draining"
+	default:
+		return fmt.Sprintf("reason(%d)", uint64(r))
+	}
+}
+
+// ReasonFromError extracts the Reason that a connection was closed with from an
+// error returned by a brpc or transport operation. It returns false if err wasn't
+// caused by the connection being closed with a reason.
+func ReasonFromError(err error) (Reason, bool) {
+	var rejectedErr *RejectedError
+	if errors.As(err, &rejectedErr) {
+		return rejectedErr.Reason, true
+	}
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		return closeErr.Reason, true
+	}
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) {
+		return 0, false
+	}
+	return Reason(appErr.ErrorCode), true
+}
+
+// closeWithReason closes conn with the provided Reason.
+func closeWithReason(conn Conn, reason Reason) error {
+	return conn.CloseWithReason(reason, reason.String())
+}
+
+// closeOnce returns a function that closes conn with a Reason and message, but
+// only the first time it is called, so that when several parties terminate a
+// connection concurrently, the peer sees the first reason and the connection is
+// only closed once. Later calls return nil.
+func closeOnce(conn Conn) func(reason Reason, message string) error {
+	var once sync.Once
+	return func(reason Reason, message string) (err error) {
+		once.Do(func() {
+			err = conn.CloseWithReason(reason, message)
+		})
+		return err
+	}
+}
+
+// NegotiationErrorCode identifies the step of establishing a client connection
+// that failed, see ErrConnectionNegotiationFailed. The values are part of the
+// API, callers may compare them numerically, so they are never renumbered.
+// ErrorCodeDialing replaces the former ErrorCodeCreatingYamuxClient and keeps
+// its value.
+type NegotiationErrorCode int
+
 const (
-	ErrorCodeCreatingYamuxClient = iota + 1
-	ErrorCodeOpeningGrpcConnection
+	ErrorCodeDialing               NegotiationErrorCode = 1 // Establishing the transport connection
+	ErrorCodeOpeningGrpcConnection NegotiationErrorCode = 2 // Opening the stream for client->server RPCs
+	ErrorCodeReceivingClientID     NegotiationErrorCode = 3 // Receiving the client id from the server
+	ErrorCodeDialingGrpc           NegotiationErrorCode = 4 // Dialing the client->server gRPC connection
+	ErrorCodeSendingHandshake      NegotiationErrorCode = 5 // Sending the HandshakeInfo to the server
 )
 
-type ErrYamuxNegotiationFailed struct {
-	code  int
+// ErrConnectionNegotiationFailed is returned when a client fails to establish a
+// connection, carrying the step that failed so callers can handle failures
+// programmatically:
+//
+//	var negotiationErr brpc.ErrConnectionNegotiationFailed
+//	if errors.As(err, &negotiationErr) && negotiationErr.Code() == brpc.ErrorCodeDialing {
+//		// The server is unreachable
+//	}
+type ErrConnectionNegotiationFailed struct {
+	code  NegotiationErrorCode
 	inner error
 }
 
-func (e ErrYamuxNegotiationFailed) Error() string {
+func (e ErrConnectionNegotiationFailed) Error() string {
 	return e.inner.Error()
 }
+
+// Code returns the step that failed.
+func (e ErrConnectionNegotiationFailed) Code() NegotiationErrorCode {
+	return e.code
+}
+
+// Unwrap returns the error that the step failed with.
+func (e ErrConnectionNegotiationFailed) Unwrap() error {
+	return e.inner
+}
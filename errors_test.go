@@ -0,0 +1,105 @@
+package brpc_test
+
+import (
+	"context"
+	"errors"
+	"github.com/clarkmcc/brpc"
+	"github.com/clarkmcc/brpc/brpctest"
+	"github.com/clarkmcc/brpc/internal/example"
+	"testing"
+)
+
+// serveBadVersion accepts a connection from listener and answers the client's
+// handshake with a protocol version that no brpc release speaks.
+func serveBadVersion(t *testing.T, listener *brpctest.Listener) {
+	t.Helper()
+	done := make(chan struct{})
+	t.Cleanup(func() { <-done })
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		conn, err := listener.Accept(ctx)
+		if err != nil {
+			t.Errorf("accepting: %v", err)
+			return
+		}
+		defer conn.CloseWithReason(brpc.ReasonNormal, "")
+		stream, err := conn.OpenUniStream(ctx)
+		if err != nil {
+			t.Errorf("opening handshake stream: %v", err)
+			return
+		}
+		if _, err := stream.Write([]byte{0}); err != nil {
+			t.Errorf("writing version: %v", err)
+		}
+		_ = stream.Close()
+		<-conn.Context().Done()
+	}()
+}
+
+func TestConnectReportsFailedNegotiationStep(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		listen func(t *testing.T) *brpctest.Listener
+		code   brpc.NegotiationErrorCode
+		is     error
+		reason brpc.Reason // Checked if not ReasonNormal
+	}{
+		{
+			name: "dialing a closed listener",
+			listen: func(t *testing.T) *brpctest.Listener {
+				listener := brpctest.NewListener()
+				_ = listener.Close()
+				return listener
+			},
+			code: brpc.ErrorCodeDialing,
+		},
+		{
+			name: "protocol version mismatch",
+			listen: func(t *testing.T) *brpctest.Listener {
+				listener := brpctest.NewListener()
+				serveBadVersion(t, listener)
+				return listener
+			},
+			code: brpc.ErrorCodeReceivingClientID,
+			is:   brpc.ErrProtocolVersionMismatch,
+		},
+		{
+			name: "handshake rejected",
+			listen: func(t *testing.T) *brpctest.Listener {
+				return startServer(t, brpc.NewServer(brpc.ServerConfig[example.NamerClient]{
+					VerifyHandshake: func(context.Context, brpc.Conn, brpc.HandshakeInfo) error {
+						return errors.New("unknown client")
+					},
+				}))
+			},
+			code:   brpc.ErrorCodeReceivingClientID,
+			reason: brpc.ReasonHandshakeRejected,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			listener := tc.listen(t)
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			conn, err := brpc.DialContext(ctx, "pipe", nil, brpc.WithTransport(listener.Transport()))
+			if err == nil {
+				_ = conn.Close()
+				t.Fatal("dialing succeeded")
+			}
+			var negotiationErr brpc.ErrConnectionNegotiationFailed
+			if !errors.As(err, &negotiationErr) {
+				t.Fatalf("got %v, want an ErrConnectionNegotiationFailed", err)
+			}
+			if negotiationErr.Code() != tc.code {
+				t.Errorf("got code %d, want %d: %v", negotiationErr.Code(), tc.code, err)
+			}
+			if tc.is != nil && !errors.Is(err, tc.is) {
+				t.Errorf("got %v, want %v", err, tc.is)
+			}
+			if reason, _ := brpc.ReasonFromError(err); tc.reason != brpc.ReasonNormal && reason != tc.reason {
+				t.Errorf("got reason %v, want %v", reason, tc.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package brpc
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.uber.org/multierr"
+	"io"
+	"slices"
+	"time"
+)
+
+// HandshakeInfo is sent by the client when it connects, before it is assigned an
+// ID, so that the server can reject incompatible or unauthorized clients early,
+// see WithHandshakeInfo and ServerConfig.VerifyHandshake.
+type HandshakeInfo struct {
+	// Version is the version of the client application.
+	Version string `json:"version,omitempty"`
+	// Capabilities lists optional features that the client supports. brpc adds
+	// its own capabilities, which start with "brpc/", such as CapabilityCallback.
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Token is an optional credential for the server to verify.
+	Token string `json:"token,omitempty"`
+	// Metadata holds arbitrary application-defined values.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// CapabilityCallback is added to HandshakeInfo.Capabilities by clients that can
+// serve server->client RPCs, that is all clients that weren't dialed
+// WithoutCallback. The server doesn't open a server->client connection to
+// clients without it.
+const CapabilityCallback = "brpc/callback"
+
+// CapabilityBinaryClientID is added to HandshakeInfo.Capabilities by clients
+// dialed WithBinaryClientID, and to ServerInfo.Capabilities by servers in reply,
+// once they agreed that the client sends its id in binary form.
+const CapabilityBinaryClientID = "brpc/binary-client-id"
+
+// hasCapability reports whether info lists capability.
+func (info HandshakeInfo) hasCapability(capability string) bool {
+	return slices.Contains(info.Capabilities, capability)
+}
+
+// hasCapability reports whether info lists capability.
+func (info ServerInfo) hasCapability(capability string) bool {
+	return slices.Contains(info.Capabilities, capability)
+}
+
+// withCapability returns info with capability added to its Capabilities, without
+// modifying the Capabilities of info itself.
+func (info ServerInfo) withCapability(capability string) ServerInfo {
+	if !info.hasCapability(capability) {
+		info.Capabilities = append(slices.Clone(info.Capabilities), capability)
+	}
+	return info
+}
+
+// ServerInfo is sent by the server along with the client's ID, see
+// ServerConfig.ServerInfo and ClientConn.ServerInfo.
+type ServerInfo struct {
+	// Version is the version of the server application.
+	Version string `json:"version,omitempty"`
+	// Capabilities lists optional features that the server supports. brpc adds
+	// its own capabilities, which start with "brpc/", such as
+	// CapabilityBinaryClientID.
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Metadata holds arbitrary application-defined values.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// The server->client handshake stream starts with the protocol version and one
+// of these, followed by the client's id and ServerInfo if the connection was
+// accepted, or by the Reason and a rejection if it was rejected.
+const (
+	handshakeAccepted byte = 0
+	handshakeRejected byte = 1
+)
+
+// rejection is the payload of a rejected handshake.
+type rejection struct {
+	Message string `json:"message,omitempty"`
+}
+
+// RejectedError is returned when dialing fails because the server rejected the
+// connection during the handshake, for example because authentication failed or
+// the server is at its connection limit. ReasonFromError reports its Reason.
+type RejectedError struct {
+	Reason  Reason
+	Message string // Describes why the server rejected the connection
+}
+
+func (e *RejectedError) Error() string {
+	if e.Message == "" || e.Message == e.Reason.String() {
+		return fmt.Sprintf("connection rejected: %s", e.Reason)
+	}
+	return fmt.Sprintf("connection rejected: %s: %s", e.Reason, e.Message)
+}
+
+// maxHandshakePayload bounds the size of the JSON payloads exchanged during the
+// handshake, so that a peer can't make the other side allocate arbitrary memory.
+const maxHandshakePayload = 64 << 10
+
+// sendHandshake sends info to the server over a unidirectional stream, as the
+// protocol version followed by info as length-prefixed JSON.
+func sendHandshake(ctx context.Context, conn Conn, info HandshakeInfo) error {
+	return writeHandshakeStream(ctx, conn, []byte{protocolVersion}, info)
+}
+
+// receiveHandshake accepts the client's handshake stream, see sendHandshake.
+func receiveHandshake(ctx context.Context, conn Conn) (info HandshakeInfo, err error) {
+	err = readHandshakeStream(ctx, conn, func(r io.Reader) error {
+		if err := readProtocolVersion(r); err != nil {
+			return err
+		}
+		return readHandshakePayload(r, &info)
+	})
+	return info, err
+}
+
+// sendClientID sends the client its id and info over a unidirectional stream, as
+// the protocol version, handshakeAccepted and the id followed by info as
+// length-prefixed JSON.
+func sendClientID(ctx context.Context, conn Conn, id uuid.UUID, info ServerInfo) error {
+	return writeHandshakeStream(ctx, conn, append([]byte{protocolVersion, handshakeAccepted}, id[:]...), info)
+}
+
+// sendRejection tells the client why its connection is rejected instead of
+// sending it an id, as the protocol version, handshakeRejected and the reason
+// followed by a rejection as length-prefixed JSON.
+func sendRejection(ctx context.Context, conn Conn, reason Reason, message string) error {
+	header := binary.BigEndian.AppendUint64([]byte{protocolVersion, handshakeRejected}, uint64(reason))
+	return writeHandshakeStream(ctx, conn, header, rejection{Message: message})
+}
+
+// getClientID accepts the stream that the server sends the client's id and the
+// server info on, see sendClientID. If the server rejected the connection, the
+// error is a *RejectedError, see sendRejection.
+func getClientID(ctx context.Context, conn Conn) (id uuid.UUID, info ServerInfo, err error) {
+	err = readHandshakeStream(ctx, conn, func(r io.Reader) error {
+		if err := readProtocolVersion(r); err != nil {
+			return err
+		}
+		var status [1]byte
+		if _, err := io.ReadFull(r, status[:]); err != nil {
+			return err
+		}
+		if status[0] == handshakeRejected {
+			return readRejection(r)
+		}
+		if status[0] != handshakeAccepted {
+			return fmt.Errorf("unknown handshake status %v", status[0])
+		}
+		n, err := io.ReadFull(r, id[:])
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("read %v bytes of the client id, expected %v", n, len(id))
+		}
+		if err != nil {
+			return err
+		}
+		return readHandshakePayload(r, &info)
+	})
+	return id, info, err
+}
+
+// readRejection reads the rest of a rejected handshake, returning it as a
+// *RejectedError.
+func readRejection(r io.Reader) error {
+	var reason [8]byte
+	if _, err := io.ReadFull(r, reason[:]); err != nil {
+		return err
+	}
+	var rejected rejection
+	if err := readHandshakePayload(r, &rejected); err != nil {
+		return err
+	}
+	return &RejectedError{Reason: Reason(binary.BigEndian.Uint64(reason[:])), Message: rejected.Message}
+}
+
+// rejectTimeout bounds how long the server waits for a rejected client to read
+// the rejection before closing the connection.
+const rejectTimeout = time.Second
+
+// reject tells the client why its connection is rejected and closes the
+// connection with reason, so that dialing fails with a *RejectedError instead of
+// a bare close. Closing a connection may discard data that the client hasn't
+// read yet, so reject waits up to rejectTimeout for the client to close the
+// connection first.
+func reject(conn Conn, reason Reason, message string) error {
+	if message == "" {
+		message = reason.String()
+	}
+	ctx, cancel := context.WithTimeout(conn.Context(), rejectTimeout)
+	defer cancel()
+	if err := sendRejection(ctx, conn, reason, message); err == nil {
+		<-ctx.Done()
+	}
+	return conn.CloseWithReason(reason, message)
+}
+
+// writeHandshakeStream opens a unidirectional stream and writes header followed
+// by payload as length-prefixed JSON to it.
+func writeHandshakeStream(ctx context.Context, conn Conn, header []byte, payload any) (err error) {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encoding handshake: %w", err)
+	}
+	if len(encoded) > maxHandshakePayload {
+		return fmt.Errorf("%w: %v bytes", ErrHandshakeTooLarge, len(encoded))
+	}
+	buf := make([]byte, 0, len(header)+4+len(encoded))
+	buf = append(buf, header...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(encoded)))
+	buf = append(buf, encoded...)
+
+	stream, err := conn.OpenUniStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer multierr.AppendFunc(&err, stream.Close)
+	defer interruptOnDone(ctx, stream.SetWriteDeadline)()
+	n, err := stream.Write(buf)
+	if err != nil && ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return fmt.Errorf("wrote %v bytes, expected %v", n, len(buf))
+	}
+	return nil
+}
+
+// readHandshakeStream accepts a unidirectional stream from the peer and passes
+// it to read, interrupting read once ctx is done.
+func readHandshakeStream(ctx context.Context, conn Conn, read func(r io.Reader) error) error {
+	stream, err := conn.AcceptUniStream(ctx)
+	if err != nil {
+		return fmt.Errorf("accepting: %w", err)
+	}
+	defer interruptOnDone(ctx, stream.SetReadDeadline)()
+	err = read(stream)
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("reading: %w", context.Cause(ctx))
+	}
+	if err != nil {
+		return fmt.Errorf("reading: %w", err)
+	}
+	return nil
+}
+
+// readProtocolVersion reads the protocol version that starts every handshake
+// stream and fails with ErrProtocolVersionMismatch if it isn't ours.
+func readProtocolVersion(r io.Reader) error {
+	var version [1]byte
+	if _, err := io.ReadFull(r, version[:]); err != nil {
+		return err
+	}
+	if version[0] != protocolVersion {
+		return fmt.Errorf("%w: got %v, expected %v", ErrProtocolVersionMismatch, version[0], protocolVersion)
+	}
+	return nil
+}
+
+// readHandshakePayload reads a length-prefixed JSON payload into v.
+func readHandshakePayload(r io.Reader, v any) error {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return fmt.Errorf("reading handshake size: %w", err)
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxHandshakePayload {
+		return fmt.Errorf("%w: %v bytes", ErrHandshakeTooLarge, n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return fmt.Errorf("reading handshake: %w", err)
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("decoding handshake: %w", err)
+	}
+	return nil
+}
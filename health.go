@@ -0,0 +1,49 @@
+package brpc
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+// HealthServer returns the health service that the server registers when
+// ServerConfig.EnableHealthService is set, nil otherwise. Use it to report the
+// status of individual services, the overall status ("") is managed by Serve.
+func (s *Server[C]) HealthServer() *health.Server {
+	return s.health
+}
+
+// registerServices registers the health and reflection services on the gRPC
+// server, if enabled. It must be called before the gRPC server starts serving,
+// and only registers the services once even if the server is served multiple
+// times.
+func (s *Server[C]) registerServices() {
+	s.registerOnce.Do(func() {
+		if s.health != nil {
+			healthpb.RegisterHealthServer(s.Server, s.health)
+		}
+		if s.reflection {
+			reflection.Register(s.Server)
+		}
+	})
+}
+
+// WithHealthService registers the standard gRPC health service on the client's
+// callback server, so the brpc server can probe the client's liveness over the
+// connection with a grpc_health_v1 client built on the client's connection,
+// see Server.ClientConnFromContext. It reports SERVING while the callback
+// server is up.
+func WithHealthService() DialOption {
+	return func(c *ClientConn) {
+		c.healthService = true
+	}
+}
+
+// registerCallbackHealth registers a health service on the callback server if
+// the client was dialed with WithHealthService.
+func (c *ClientConn) registerCallbackHealth(registrar grpc.ServiceRegistrar) {
+	if c.healthService {
+		healthpb.RegisterHealthServer(registrar, health.NewServer())
+	}
+}
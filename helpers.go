@@ -6,58 +6,159 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/quic-go/quic-go"
-	"go.uber.org/multierr"
 	"google.golang.org/grpc"
-	"io"
+	"google.golang.org/grpc/keepalive"
 	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-func getClientID(ctx context.Context, conn quic.Connection) (id uuid.UUID, err error) {
-	stream, err := conn.AcceptUniStream(ctx)
-	if err != nil {
-		return id, fmt.Errorf("accepting: %w", err)
-	}
-	// Server closes the client
-	n, err := stream.Read(id[:])
-	if err != nil && !errors.Is(err, io.EOF) {
-		return id, fmt.Errorf("reading: %w", err)
+// protocolVersion is written as the first byte of both handshake streams so that
+// peers speaking an incompatible wire format fail loudly instead of misreading bytes.
+// Version 2 added the HandshakeInfo and ServerInfo payloads, version 3 the
+// rejection of a handshake, version 4 the type that every bidirectional stream
+// starts with.
+const protocolVersion byte = 4
+
+// newClientID is the default ClientIDFunc, it assigns each connection a random UUID.
+func newClientID(_ context.Context, _ Conn) (uuid.UUID, error) {
+	return uuid.NewRandom()
+}
+
+// interruptOnDone applies the deadline of ctx to a stream with setDeadline, and
+// interrupts blocked reads or writes by moving the deadline into the past once
+// ctx is done, which covers cancellation as well. The returned func must be
+// called once the stream is no longer used.
+func interruptOnDone(ctx context.Context, setDeadline func(t time.Time) error) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = setDeadline(deadline)
 	}
-	if n != len(id) {
-		return id, fmt.Errorf("read %v bytes, expected %v", n, len(id))
+	stopAfter := context.AfterFunc(ctx, func() {
+		_ = setDeadline(time.Now())
+	})
+	return func() {
+		stopAfter()
 	}
-	return id, nil
 }
 
-func sendClientID(ctx context.Context, conn quic.Connection) (id uuid.UUID, err error) {
-	id = uuid.New()
-	stream, err := conn.OpenUniStreamSync(ctx)
-	if err != nil {
-		return id, err
+// defaultHandshakeTimeout bounds the handshake when no timeout is configured.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// withHandshakeTimeout bounds ctx by the handshake timeout. Once the timeout
+// expires, the context's cause is ErrHandshakeTimeout.
+func withHandshakeTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
 	}
-	defer multierr.AppendFunc(&err, stream.Close)
-	n, err := stream.Write(id[:])
-	if err != nil {
-		return id, err
+	return context.WithTimeoutCause(ctx, timeout, ErrHandshakeTimeout)
+}
+
+// handshakeError wraps err with ErrHandshakeTimeout if it was caused by the
+// handshake deadline of ctx expiring.
+func handshakeError(ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, ErrHandshakeTimeout) {
+		return err
 	}
-	if n != len(id) {
-		return id, fmt.Errorf("wrote %v bytes, expected %v", n, len(id))
+	if errors.Is(context.Cause(ctx), ErrHandshakeTimeout) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrHandshakeTimeout, err)
 	}
-	return id, nil
+	return err
 }
 
 // dial is a wrapper around grpc.Dial(...) that handles tunneling over an already existing
 // net.Conn. It does not require a target address, as the connection is already established.
-func dial(stream quic.Stream, options ...grpc.DialOption) (*grpc.ClientConn, error) {
-	return grpc.Dial("", append(options, withContextDialer(&quicConn{Stream: stream}))...)
+func dial(stream net.Conn, options ...grpc.DialOption) (*grpc.ClientConn, error) {
+	return grpc.Dial("", append(options, withContextDialer(stream))...)
 }
 
 // withContextDialer is a grpc.DialOption that allows you to provide a net.Conn to use
 // for a gRPC client connection. When provided, users do not need to specify a
+// target address.
+//
+// The connection is dedicated to a single gRPC transport, so it is only handed
+// out once. If gRPC tries to reconnect after the stream failed, dialing fails
+// instead of reusing the broken stream.
 func withContextDialer(conn net.Conn) grpc.DialOption {
+	var dialed atomic.Bool
 	return grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
 		if conn == nil {
 			return nil, fmt.Errorf("no connection provided")
 		}
+		if !dialed.CompareAndSwap(false, true) {
+			return nil, ErrStreamAlreadyDialed
+		}
 		return conn, nil
 	})
 }
+
+// messageSizeDialOptions returns the dial options that limit the messages sent
+// and received on a connection to size bytes, none if size is zero.
+func messageSizeDialOptions(size int) []grpc.DialOption {
+	if size <= 0 {
+		return nil
+	}
+	return []grpc.DialOption{grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(size), grpc.MaxCallSendMsgSize(size))}
+}
+
+// messageSizeServerOptions returns the server options that limit the messages
+// sent and received by a server to size bytes, none if size is zero.
+func messageSizeServerOptions(size int) []grpc.ServerOption {
+	if size <= 0 {
+		return nil
+	}
+	return []grpc.ServerOption{grpc.MaxRecvMsgSize(size), grpc.MaxSendMsgSize(size)}
+}
+
+// clientIDMetadataKey returns the metadata key that carries the client id,
+// DefaultClientIDMetadataKey if key is empty. gRPC lowercases metadata keys, so
+// key is lowercased to match.
+func clientIDMetadataKey(key string) string {
+	if key == "" {
+		return DefaultClientIDMetadataKey
+	}
+	return strings.ToLower(key)
+}
+
+// binaryMetadataKey returns the metadata key that carries the binary form of the
+// client id, which is key with the "-bin" suffix that gRPC requires for binary
+// values.
+func binaryMetadataKey(key string) string {
+	return key + "-bin"
+}
+
+// keepaliveDialOptions returns the dial options that make a connection send
+// gRPC keepalive pings with params, none if params.Time is zero.
+func keepaliveDialOptions(params keepalive.ClientParameters) []grpc.DialOption {
+	if params.Time <= 0 {
+		return nil
+	}
+	return []grpc.DialOption{grpc.WithKeepaliveParams(params)}
+}
+
+// callbackKeepaliveMinTime is the most frequent rate at which the client's
+// callback server accepts keepalive pings from the brpc server, see
+// ServerConfig.CallbackKeepalive. gRPC clients never ping more often than every
+// 10s, the server's default of 5 minutes would make it close the connection.
+const callbackKeepaliveMinTime = 5 * time.Second
+
+// withKeepAlive returns a copy of config with QUIC keep-alives sent at the provided
+// period. If config doesn't specify a MaxIdleTimeout, it is set to three periods so
+// that a couple of lost keep-alives don't close the connection. A zero period
+// returns config unchanged.
+func withKeepAlive(config *quic.Config, period time.Duration) *quic.Config {
+	if period <= 0 {
+		return config
+	}
+	if config == nil {
+		config = &quic.Config{}
+	} else {
+		config = config.Clone()
+	}
+	config.KeepAlivePeriod = period
+	if config.MaxIdleTimeout == 0 {
+		config.MaxIdleTimeout = 3 * period
+	}
+	return config
+}
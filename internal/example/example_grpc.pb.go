@@ -23,6 +23,13 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type GreeterClient interface {
 	Greet(ctx context.Context, in *GreetRequest, opts ...grpc.CallOption) (*GreetResponse, error)
+	// GreetAll greets every name that the client streams back from Namer.Names.
+	GreetAll(ctx context.Context, in *GreetRequest, opts ...grpc.CallOption) (*GreetResponse, error)
+	// GreetStream streams a greeting for every name that the client answers over
+	// Namer.NameEach.
+	GreetStream(ctx context.Context, in *GreetRequest, opts ...grpc.CallOption) (Greeter_GreetStreamClient, error)
+	// GreetEach answers every name that the client streams with a greeting.
+	GreetEach(ctx context.Context, opts ...grpc.CallOption) (Greeter_GreetEachClient, error)
 }
 
 type greeterClient struct {
@@ -42,11 +49,90 @@ func (c *greeterClient) Greet(ctx context.Context, in *GreetRequest, opts ...grp
 	return out, nil
 }
 
+func (c *greeterClient) GreetAll(ctx context.Context, in *GreetRequest, opts ...grpc.CallOption) (*GreetResponse, error) {
+	out := new(GreetResponse)
+	err := c.cc.Invoke(ctx, "/Greeter/GreetAll", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *greeterClient) GreetStream(ctx context.Context, in *GreetRequest, opts ...grpc.CallOption) (Greeter_GreetStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Greeter_ServiceDesc.Streams[0], "/Greeter/GreetStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &greeterGreetStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Greeter_GreetStreamClient interface {
+	Recv() (*GreetResponse, error)
+	grpc.ClientStream
+}
+
+type greeterGreetStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *greeterGreetStreamClient) Recv() (*GreetResponse, error) {
+	m := new(GreetResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *greeterClient) GreetEach(ctx context.Context, opts ...grpc.CallOption) (Greeter_GreetEachClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Greeter_ServiceDesc.Streams[1], "/Greeter/GreetEach", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &greeterGreetEachClient{stream}
+	return x, nil
+}
+
+type Greeter_GreetEachClient interface {
+	Send(*NameResponse) error
+	Recv() (*GreetResponse, error)
+	grpc.ClientStream
+}
+
+type greeterGreetEachClient struct {
+	grpc.ClientStream
+}
+
+func (x *greeterGreetEachClient) Send(m *NameResponse) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *greeterGreetEachClient) Recv() (*GreetResponse, error) {
+	m := new(GreetResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // GreeterServer is the server API for Greeter service.
 // All implementations must embed UnimplementedGreeterServer
 // for forward compatibility
 type GreeterServer interface {
 	Greet(context.Context, *GreetRequest) (*GreetResponse, error)
+	// GreetAll greets every name that the client streams back from Namer.Names.
+	GreetAll(context.Context, *GreetRequest) (*GreetResponse, error)
+	// GreetStream streams a greeting for every name that the client answers over
+	// Namer.NameEach.
+	GreetStream(*GreetRequest, Greeter_GreetStreamServer) error
+	// GreetEach answers every name that the client streams with a greeting.
+	GreetEach(Greeter_GreetEachServer) error
 	mustEmbedUnimplementedGreeterServer()
 }
 
@@ -57,6 +143,15 @@ type UnimplementedGreeterServer struct {
 func (UnimplementedGreeterServer) Greet(context.Context, *GreetRequest) (*GreetResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Greet not implemented")
 }
+func (UnimplementedGreeterServer) GreetAll(context.Context, *GreetRequest) (*GreetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GreetAll not implemented")
+}
+func (UnimplementedGreeterServer) GreetStream(*GreetRequest, Greeter_GreetStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method GreetStream not implemented")
+}
+func (UnimplementedGreeterServer) GreetEach(Greeter_GreetEachServer) error {
+	return status.Errorf(codes.Unimplemented, "method GreetEach not implemented")
+}
 func (UnimplementedGreeterServer) mustEmbedUnimplementedGreeterServer() {}
 
 // UnsafeGreeterServer may be embedded to opt out of forward compatibility for this service.
@@ -88,6 +183,71 @@ func _Greeter_Greet_Handler(srv interface{}, ctx context.Context, dec func(inter
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Greeter_GreetAll_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GreetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GreeterServer).GreetAll(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Greeter/GreetAll",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GreeterServer).GreetAll(ctx, req.(*GreetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Greeter_GreetStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GreetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GreeterServer).GreetStream(m, &greeterGreetStreamServer{stream})
+}
+
+type Greeter_GreetStreamServer interface {
+	Send(*GreetResponse) error
+	grpc.ServerStream
+}
+
+type greeterGreetStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *greeterGreetStreamServer) Send(m *GreetResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Greeter_GreetEach_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(GreeterServer).GreetEach(&greeterGreetEachServer{stream})
+}
+
+type Greeter_GreetEachServer interface {
+	Send(*GreetResponse) error
+	Recv() (*NameResponse, error)
+	grpc.ServerStream
+}
+
+type greeterGreetEachServer struct {
+	grpc.ServerStream
+}
+
+func (x *greeterGreetEachServer) Send(m *GreetResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *greeterGreetEachServer) Recv() (*NameResponse, error) {
+	m := new(NameResponse)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Greeter_ServiceDesc is the grpc.ServiceDesc for Greeter service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -99,8 +259,24 @@ var Greeter_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Greet",
 			Handler:    _Greeter_Greet_Handler,
 		},
+		{
+			MethodName: "GreetAll",
+			Handler:    _Greeter_GreetAll_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GreetStream",
+			Handler:       _Greeter_GreetStream_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "GreetEach",
+			Handler:       _Greeter_GreetEach_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "example.proto",
 }
 
@@ -109,6 +285,9 @@ var Greeter_ServiceDesc = grpc.ServiceDesc{
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type NamerClient interface {
 	Name(ctx context.Context, in *NameRequest, opts ...grpc.CallOption) (*NameResponse, error)
+	Names(ctx context.Context, in *NameRequest, opts ...grpc.CallOption) (Namer_NamesClient, error)
+	// NameEach answers every request with a name.
+	NameEach(ctx context.Context, opts ...grpc.CallOption) (Namer_NameEachClient, error)
 }
 
 type namerClient struct {
@@ -128,11 +307,77 @@ func (c *namerClient) Name(ctx context.Context, in *NameRequest, opts ...grpc.Ca
 	return out, nil
 }
 
+func (c *namerClient) Names(ctx context.Context, in *NameRequest, opts ...grpc.CallOption) (Namer_NamesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Namer_ServiceDesc.Streams[0], "/Namer/Names", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &namerNamesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Namer_NamesClient interface {
+	Recv() (*NameResponse, error)
+	grpc.ClientStream
+}
+
+type namerNamesClient struct {
+	grpc.ClientStream
+}
+
+func (x *namerNamesClient) Recv() (*NameResponse, error) {
+	m := new(NameResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *namerClient) NameEach(ctx context.Context, opts ...grpc.CallOption) (Namer_NameEachClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Namer_ServiceDesc.Streams[1], "/Namer/NameEach", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &namerNameEachClient{stream}
+	return x, nil
+}
+
+type Namer_NameEachClient interface {
+	Send(*NameRequest) error
+	Recv() (*NameResponse, error)
+	grpc.ClientStream
+}
+
+type namerNameEachClient struct {
+	grpc.ClientStream
+}
+
+func (x *namerNameEachClient) Send(m *NameRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *namerNameEachClient) Recv() (*NameResponse, error) {
+	m := new(NameResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // NamerServer is the server API for Namer service.
 // All implementations must embed UnimplementedNamerServer
 // for forward compatibility
 type NamerServer interface {
 	Name(context.Context, *NameRequest) (*NameResponse, error)
+	Names(*NameRequest, Namer_NamesServer) error
+	// NameEach answers every request with a name.
+	NameEach(Namer_NameEachServer) error
 	mustEmbedUnimplementedNamerServer()
 }
 
@@ -143,6 +388,12 @@ type UnimplementedNamerServer struct {
 func (UnimplementedNamerServer) Name(context.Context, *NameRequest) (*NameResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Name not implemented")
 }
+func (UnimplementedNamerServer) Names(*NameRequest, Namer_NamesServer) error {
+	return status.Errorf(codes.Unimplemented, "method Names not implemented")
+}
+func (UnimplementedNamerServer) NameEach(Namer_NameEachServer) error {
+	return status.Errorf(codes.Unimplemented, "method NameEach not implemented")
+}
 func (UnimplementedNamerServer) mustEmbedUnimplementedNamerServer() {}
 
 // UnsafeNamerServer may be embedded to opt out of forward compatibility for this service.
@@ -174,6 +425,53 @@ func _Namer_Name_Handler(srv interface{}, ctx context.Context, dec func(interfac
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Namer_Names_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(NameRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(NamerServer).Names(m, &namerNamesServer{stream})
+}
+
+type Namer_NamesServer interface {
+	Send(*NameResponse) error
+	grpc.ServerStream
+}
+
+type namerNamesServer struct {
+	grpc.ServerStream
+}
+
+func (x *namerNamesServer) Send(m *NameResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Namer_NameEach_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(NamerServer).NameEach(&namerNameEachServer{stream})
+}
+
+type Namer_NameEachServer interface {
+	Send(*NameResponse) error
+	Recv() (*NameRequest, error)
+	grpc.ServerStream
+}
+
+type namerNameEachServer struct {
+	grpc.ServerStream
+}
+
+func (x *namerNameEachServer) Send(m *NameResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *namerNameEachServer) Recv() (*NameRequest, error) {
+	m := new(NameRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Namer_ServiceDesc is the grpc.ServiceDesc for Namer service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -186,6 +484,18 @@ var Namer_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _Namer_Name_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Names",
+			Handler:       _Namer_Names_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "NameEach",
+			Handler:       _Namer_NameEach_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
 	Metadata: "example.proto",
 }
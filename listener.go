@@ -3,12 +3,14 @@ package brpc
 import (
 	"context"
 	"errors"
-	"github.com/quic-go/quic-go"
+	"fmt"
+	"github.com/google/uuid"
 	"go.uber.org/multierr"
 	"io"
 	"log/slog"
 	"net"
 	"os"
+	"reflect"
 	"sync"
 	"syscall"
 )
@@ -21,47 +23,78 @@ var _ net.Listener = &multiListener{}
 // net.Listeners.
 //
 // In our case, brpc servers use this because we want to handle incoming connections
-// ourselves first (to negotiate a yamux session, pass client ids, etc), and then
-// pass the yamux.Session (which implements net.Listener) into the multiListener
-// so that our gRPC server can accept all future connections from the yamux.Session.
+// ourselves first (to pass client ids, open the server->client stream, etc), and
+// then pass a listener for the connection's streams into the multiListener so that
+// our gRPC server can accept all future streams from that connection.
+//
+// Every listener delivers connections over its own channel, and Accept picks
+// uniformly at random between the listeners that have a connection ready, so that
+// a busy listener can't starve the others.
 type multiListener struct {
 	listenersLock sync.Mutex
-	listeners     []net.Listener
-	connChan      chan net.Conn
-	errChan       chan error // errors on this channel
+	listeners     []*listenerQueue
+	closed        bool          // Set by Close, listeners added afterwards are closed right away
+	addr          net.Addr      // Reported by Addr if set, see setAddr
+	changed       chan struct{} // Closed and replaced whenever listeners changes
 	closeChan     chan struct{}
 	wg            sync.WaitGroup
 	logger        *slog.Logger
+
+	// onError is called when an added listener fails with a non-transient error.
+	// The failing listener is removed, but the multiListener keeps accepting from
+	// the others. Defaults to logging the error.
+	onError func(l net.Listener, err error)
+}
+
+// listenerQueue is a listener added to a multiListener, along with the channel
+// that its accept goroutine delivers connections on.
+type listenerQueue struct {
+	listener net.Listener
+	conns    chan net.Conn
 }
 
 func newMultiListener() *multiListener {
-	return &multiListener{
-		connChan:  make(chan net.Conn),
-		errChan:   make(chan error, 1), // buffered channel for at least one error
+	ml := &multiListener{
+		changed:   make(chan struct{}),
 		closeChan: make(chan struct{}),
 		logger:    slog.Default(),
 	}
+	ml.onError = func(_ net.Listener, err error) {
+		ml.logger.Warn("error accepting connection", "error", err)
+	}
+	return ml
 }
 
 func (ml *multiListener) AddListener(l net.Listener) {
+	q := &listenerQueue{listener: l, conns: make(chan net.Conn)}
+	// Checking closed and adding to wg under the same lock that Close takes
+	// makes sure Close either closes l or waits for its accept goroutine.
 	ml.listenersLock.Lock()
-	ml.listeners = append(ml.listeners, l)
+	if ml.closed {
+		ml.listenersLock.Unlock()
+		_ = l.Close()
+		return
+	}
+	ml.listeners = append(ml.listeners, q)
+	close(ml.changed)
+	ml.changed = make(chan struct{})
+	ml.wg.Add(1)
 	ml.listenersLock.Unlock()
 
-	ml.wg.Add(1)
 	go func() {
 		defer ml.wg.Done()
+		defer ml.removeListener(q)
 		for {
 			conn, err := l.Accept()
 			if err != nil {
 				if !isTransientError(err) {
-					slog.Warn("error accepting connection", "error", err)
+					ml.onError(l, err)
 				}
 				return
 			}
 
 			select {
-			case ml.connChan <- conn:
+			case q.conns <- conn:
 			case <-ml.closeChan:
 				return
 			}
@@ -69,31 +102,106 @@ func (ml *multiListener) AddListener(l net.Listener) {
 	}()
 }
 
+// removeListener forgets about a listener whose accept goroutine has exited, so
+// that servers with many short-lived clients don't accumulate dead listeners.
+func (ml *multiListener) removeListener(q *listenerQueue) {
+	ml.listenersLock.Lock()
+	defer ml.listenersLock.Unlock()
+	for i, other := range ml.listeners {
+		if other == q {
+			ml.listeners = append(ml.listeners[:i], ml.listeners[i+1:]...)
+			close(ml.changed)
+			ml.changed = make(chan struct{})
+			break
+		}
+	}
+	// The listener is no longer usable, but it may still hold resources
+	_ = q.listener.Close()
+}
+
+// Accept returns the next connection from any of the listeners. The only error
+// it returns is net.ErrClosed, once the multiListener is closed, which makes the
+// gRPC server serving the multiListener stop. A single listener failing must not
+// stop that server, since every listener belongs to a single client, so those
+// errors are reported through onError and the listener is removed instead.
 func (ml *multiListener) Accept() (net.Conn, error) {
-	select {
-	case conn := <-ml.connChan:
-		return conn, nil
-	case err := <-ml.errChan:
-		return nil, err
-	case <-ml.closeChan:
-		return nil, net.ErrClosed
+	const (
+		closeCase = iota
+		changedCase
+		firstListenerCase
+	)
+	for {
+		ml.listenersLock.Lock()
+		cases := make([]reflect.SelectCase, firstListenerCase, firstListenerCase+len(ml.listeners))
+		cases[closeCase] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ml.closeChan)}
+		cases[changedCase] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ml.changed)}
+		for _, q := range ml.listeners {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.conns)})
+		}
+		ml.listenersLock.Unlock()
+
+		// reflect.Select chooses pseudo-randomly between all ready cases
+		chosen, value, _ := reflect.Select(cases)
+		switch chosen {
+		case closeCase:
+			return nil, net.ErrClosed
+		case changedCase:
+			continue
+		default:
+			return value.Interface().(net.Conn), nil
+		}
 	}
 }
 
 func (ml *multiListener) Close() error {
 	close(ml.closeChan)
-	ml.wg.Wait()
+	// The accept goroutines are blocked in Accept until their listener is
+	// closed, so we close the listeners before waiting for the goroutines.
 	var err error
-	for _, l := range ml.listeners {
-		err = multierr.Append(err, l.Close())
+	ml.listenersLock.Lock()
+	ml.closed = true
+	for _, q := range ml.listeners {
+		err = multierr.Append(err, q.listener.Close())
 	}
+	ml.listenersLock.Unlock()
+	ml.wg.Wait()
 	return err
 }
 
+// setAddr sets the address that Addr reports, which brpc servers set to the
+// address of the Listener that connections are accepted from.
+func (ml *multiListener) setAddr(addr net.Addr) {
+	ml.listenersLock.Lock()
+	defer ml.listenersLock.Unlock()
+	ml.addr = addr
+}
+
+// Addr returns the address set with setAddr. If it wasn't set, the address of
+// the oldest added listener is returned instead, and an empty address if there
+// are no listeners. See Addrs for the addresses of all listeners.
 func (ml *multiListener) Addr() net.Addr {
+	ml.listenersLock.Lock()
+	defer ml.listenersLock.Unlock()
+	if ml.addr != nil {
+		return ml.addr
+	}
+	if len(ml.listeners) > 0 {
+		return ml.listeners[0].listener.Addr()
+	}
 	return &net.TCPAddr{}
 }
 
+// Addrs returns the addresses of all listeners, oldest first.
+func (ml *multiListener) Addrs() []net.Addr {
+	ml.listenersLock.Lock()
+	defer ml.listenersLock.Unlock()
+	addrs := make([]net.Addr, 0, len(ml.listeners))
+	for _, q := range ml.listeners {
+		addrs = append(addrs, q.listener.Addr())
+	}
+	return addrs
+}
+
 func isTransientError(err error) bool {
 	// Directly check for net.ErrClosed or io.EOF
 	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
@@ -112,41 +220,190 @@ func isTransientError(err error) bool {
 	return false
 }
 
-var _ net.Conn = &quicConn{}
+var _ net.Listener = &connListener{}
 
-// quicConn is a net.Conn implementation that wraps a quic.Stream.
-type quicConn struct {
-	quic.Stream
+// connListener is a net.Listener implementation that wraps a Conn and allows
+// consumers of a net.Listener to accept bi-directional streams. It only sees the
+// streams that the peer opened, see Conn for how streams are routed, and only
+// returns those of streamType, other streams are closed.
+//
+// Closing the listener only stops accepting new streams, the connection and
+// the streams that were already accepted stay open. This lets gRPC close its
+// listeners during GracefulStop while in-flight RPCs drain, and keeps the
+// multiListener from tearing down a client when it removes a failed listener.
+// The owner of the connection is responsible for closing it.
+type connListener struct {
+	conn       Conn
+	streamType byte
+	ctx        context.Context // Cancelled when the listener is closed
+	cancel     context.CancelFunc
+	streams    chan typedStream // Streams whose type was read
+	err        error            // Why accepting streams stopped, set before done is closed
+	done       chan struct{}
+}
+
+// typedStream is a stream that the peer opened, along with its type.
+type typedStream struct {
+	stream     net.Conn
+	streamType byte
 }
 
-func (q *quicConn) LocalAddr() net.Addr {
-	return (*net.TCPAddr)(nil)
+func newConnListener(conn Conn, streamType byte) *connListener {
+	ctx, cancel := context.WithCancel(conn.Context())
+	q := &connListener{
+		conn:       conn,
+		streamType: streamType,
+		ctx:        ctx,
+		cancel:     cancel,
+		streams:    make(chan typedStream),
+		done:       make(chan struct{}),
+	}
+	go q.acceptLoop()
+	return q
 }
 
-func (q *quicConn) RemoteAddr() net.Addr {
-	return (*net.TCPAddr)(nil)
+func (q *connListener) Accept() (net.Conn, error) {
+	for {
+		stream, streamType, err := q.accept()
+		if err != nil {
+			return nil, err
+		}
+		if streamType == q.streamType {
+			return stream, nil
+		}
+		_ = stream.Close()
+	}
 }
 
-var _ net.Listener = &quicListener{}
+// accept returns the next stream that the peer opened, along with its type.
+func (q *connListener) accept() (net.Conn, byte, error) {
+	select {
+	case s := <-q.streams:
+		return s.stream, s.streamType, nil
+	case <-q.done:
+		return nil, 0, q.err
+	}
+}
 
-// quicListener is a net.Listener implementation that wraps a quic.Connection
-// and allows consumers of a net.Listener to accept bi-directional quic streams.
-type quicListener struct {
-	conn quic.Connection
+// acceptLoop accepts the streams that the peer opens until the listener or the
+// connection is closed. The type of every stream is read in its own goroutine,
+// so that a stream whose type is slow to arrive doesn't hold up the others.
+func (q *connListener) acceptLoop() {
+	for {
+		stream, err := q.conn.AcceptStream(q.ctx)
+		if err != nil {
+			q.err = q.acceptErr(err)
+			close(q.done)
+			return
+		}
+		go q.readType(stream)
+	}
 }
 
-func (q *quicListener) Accept() (net.Conn, error) {
-	stream, err := q.conn.AcceptStream(context.Background())
+// readType reads the type of stream and hands it to accept. Streams whose type
+// can't be read are closed and skipped.
+func (q *connListener) readType(stream net.Conn) {
+	streamType, err := readStreamType(stream)
 	if err != nil {
-		return nil, err
+		_ = stream.Close()
+		return
+	}
+	select {
+	case q.streams <- typedStream{stream: stream, streamType: streamType}:
+	case <-q.ctx.Done():
+		_ = stream.Close()
+	}
+}
+
+// acceptErr returns the error that Accept returns once accepting streams failed
+// with err.
+func (q *connListener) acceptErr(err error) error {
+	if q.ctx.Err() != nil && q.conn.Context().Err() == nil {
+		return net.ErrClosed
+	}
+	if q.conn.Context().Err() != nil {
+		// The connection was closed, by either side, which is the normal
+		// way for a client's listener to end.
+		return fmt.Errorf("%w: %w", net.ErrClosed, err)
 	}
-	return &quicConn{Stream: stream}, nil
+	return err
+}
+
+func (q *connListener) Close() error {
+	q.cancel()
+	return nil
+}
+
+// Addr returns the local address of the connection that streams are accepted from.
+func (q *connListener) Addr() net.Addr {
+	return q.conn.LocalAddr()
+}
+
+// clientListener is a connListener for a client's connection on the server. The
+// streams it accepts report a clientAddr as their remote address, which gRPC
+// exposes to handlers through the peer, binding every RPC to the client id that
+// was assigned to the connection.
+//
+// Raw streams that the client opens with ClientConn.OpenRawStream are handed to
+// raw instead, or closed if raw is nil.
+type clientListener struct {
+	*connListener
+	id    uuid.UUID
+	bytes *byteCounter // Counts the traffic on accepted gRPC streams
+	raw   RawStreamHandler
+}
+
+func newClientListener(conn Conn, id uuid.UUID, bytes *byteCounter, raw RawStreamHandler) *clientListener {
+	return &clientListener{
+		connListener: newConnListener(conn, streamTypeGRPCClientToServer),
+		id:           id,
+		bytes:        bytes,
+		raw:          raw,
+	}
+}
+
+func (l *clientListener) Accept() (net.Conn, error) {
+	for {
+		stream, streamType, err := l.accept()
+		if err != nil {
+			return nil, err
+		}
+		switch streamType {
+		case streamTypeGRPCClientToServer:
+			return &clientStream{
+				Conn: l.bytes.wrap(stream),
+				addr: &clientAddr{Addr: l.conn.RemoteAddr(), id: l.id},
+			}, nil
+		case streamTypeRaw:
+			go l.serveRaw(stream)
+		default:
+			_ = stream.Close()
+		}
+	}
+}
+
+// serveRaw hands a raw stream to the raw stream handler, and closes it once the
+// handler returns.
+func (l *clientListener) serveRaw(stream net.Conn) {
+	defer stream.Close()
+	if l.raw != nil {
+		l.raw(l.conn.Context(), l.id, stream)
+	}
+}
+
+// clientStream is a stream accepted from a client's connection.
+type clientStream struct {
+	net.Conn
+	addr *clientAddr
 }
 
-func (q *quicListener) Close() error {
-	return q.conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+func (c *clientStream) RemoteAddr() net.Addr {
+	return c.addr
 }
 
-func (q *quicListener) Addr() net.Addr {
-	return (*net.TCPAddr)(nil)
+// clientAddr is the remote address of a client's connection, tagged with the id
+// that the server assigned to it.
+type clientAddr struct {
+	net.Addr
+	id uuid.UUID
 }
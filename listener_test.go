@@ -0,0 +1,143 @@
+package brpc
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeListener is a net.Listener that hands out the connections sent on conns.
+type fakeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeListener() *fakeListener {
+	return &fakeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *fakeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// produce sends n connections tagged with source on l, or endless connections if
+// n is negative, until l is closed.
+func (l *fakeListener) produce(source, n int) {
+	for i := 0; n < 0 || i < n; i++ {
+		select {
+		case l.conns <- &taggedConn{source: source}:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// taggedConn is a connection that remembers which listener it came from.
+type taggedConn struct {
+	net.Conn
+	source int
+}
+
+func TestMultiListenerAcceptIsFair(t *testing.T) {
+	const listeners, conns = 4, 100
+	ml := newMultiListener()
+	defer ml.Close()
+	for i := 0; i < listeners; i++ {
+		l := newFakeListener()
+		go l.produce(i, conns)
+		ml.AddListener(l)
+	}
+
+	// With every listener ready, each should get about a quarter of the first
+	// half of the connections, not all of them in order.
+	var accepted [listeners]int
+	for i := 0; i < listeners*conns/2; i++ {
+		conn, err := ml.Accept()
+		if err != nil {
+			t.Fatalf("accepting: %v", err)
+		}
+		accepted[conn.(*taggedConn).source]++
+	}
+	for source, n := range accepted {
+		if n < conns/4 || n > conns*3/4 {
+			t.Errorf("listener %d got %d of the first %d connections: %v", source, n, listeners*conns/2, accepted)
+		}
+	}
+}
+
+func TestMultiListenerBusyListenerDoesNotStarveOthers(t *testing.T) {
+	ml := newMultiListener()
+	defer ml.Close()
+	busy, quiet := newFakeListener(), newFakeListener()
+	go busy.produce(0, -1)
+	go quiet.produce(1, 1)
+	ml.AddListener(busy)
+	ml.AddListener(quiet)
+
+	for i := 0; i < 1000; i++ {
+		conn, err := ml.Accept()
+		if err != nil {
+			t.Fatalf("accepting: %v", err)
+		}
+		if conn.(*taggedConn).source == 1 {
+			return
+		}
+	}
+	t.Fatal("the quiet listener's connection wasn't accepted next to a busy listener")
+}
+
+func TestMultiListenerClosesListenersAddedAfterClose(t *testing.T) {
+	ml := newMultiListener()
+	if err := ml.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l := newFakeListener()
+	ml.AddListener(l)
+	select {
+	case <-l.done:
+	default:
+		t.Fatal("listener added after Close is still open")
+	}
+}
+
+func TestMultiListenerAddListenerDuringClose(t *testing.T) {
+	const adders = 50
+	ml := newMultiListener()
+	listeners := make([]*fakeListener, adders)
+	var wg sync.WaitGroup
+	for i := range listeners {
+		listeners[i] = newFakeListener()
+		wg.Add(1)
+		go func(l *fakeListener) {
+			defer wg.Done()
+			ml.AddListener(l)
+		}(listeners[i])
+	}
+	if err := ml.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	// Every listener was either closed by Close or by AddListener
+	for i, l := range listeners {
+		select {
+		case <-l.done:
+		default:
+			t.Fatalf("listener %d is still open", i)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package brpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"net"
+)
+
+// CapabilityRawStreams is added to ServerInfo.Capabilities by servers with a
+// ServerConfig.RawStreamHandler, which accept the streams that clients open with
+// ClientConn.OpenRawStream.
+const CapabilityRawStreams = "brpc/raw-streams"
+
+// RawStreamHandler handles a raw stream that the client with id opened with
+// ClientConn.OpenRawStream, see ServerConfig.RawStreamHandler. ctx is done once
+// the client's connection is closed.
+type RawStreamHandler func(ctx context.Context, id uuid.UUID, stream net.Conn)
+
+// OpenRawStream opens a raw bidirectional byte stream to the server over the
+// existing connection, next to the gRPC calls, for example to transfer files or
+// to tunnel another protocol. The server hands the stream to its
+// ServerConfig.RawStreamHandler, and fails with ErrRawStreamsUnsupported if it
+// has none. The stream belongs to the current connection, so it fails once the
+// connection is lost, even if the ClientConn reconnects. The caller must close
+// the stream. Streams of the built-in transports implement
+// interface{ CloseWrite() error } to signal the end of the data to the peer
+// while still reading its reply.
+func (c *ClientConn) OpenRawStream(ctx context.Context) (net.Conn, error) {
+	c.mu.RLock()
+	conn, serverInfo := c.conn, c.serverInfo
+	c.mu.RUnlock()
+	if !serverInfo.hasCapability(CapabilityRawStreams) {
+		return nil, ErrRawStreamsUnsupported
+	}
+	stream, err := openTypedStream(ctx, conn, streamTypeRaw)
+	if err != nil {
+		return nil, fmt.Errorf("opening raw stream: %w", err)
+	}
+	return stream, nil
+}
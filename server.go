@@ -2,6 +2,8 @@ package brpc
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/clarkmcc/brpc/internal/grpcsync"
@@ -11,14 +13,25 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
-	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/peer"
 	"io"
 	"log/slog"
+	"net"
 	"reflect"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const metadataClientIDKey = "brpc-metadata-client-id"
+// DefaultClientIDMetadataKey is the gRPC metadata key that carries the client id
+// on RPCs in both directions, unless ServerConfig.ClientIDMetadataKey and
+// WithClientIDMetadataKey configure another one.
+const DefaultClientIDMetadataKey = "brpc-metadata-client-id"
 
 // Server is a bidirectional gRPC server that allows you to plug in your own gRPC server,
 // as well as a gRPC client which your gRPC server can use to call client RPCs.
@@ -27,107 +40,572 @@ const metadataClientIDKey = "brpc-metadata-client-id"
 // future communication, including client->server RPCs and server->client RPCs over a
 // single TCP connection.
 type Server[C any] struct {
-	Logger *slog.Logger
+	Logger *slog.Logger // Defaults to slog.Default() if nil
 	*grpc.Server
 
 	clientServiceBuilder  func(conn grpc.ClientConnInterface) C
+	clientServices        *clientServices // Registered with RegisterClientService
+	clientIDFunc          ClientIDFunc
+	keepListenerOpen      bool
+	idleTimeout           time.Duration
+	quicConfig            *quic.Config
+	requireClientCert     bool
+	clientCAs             *x509.CertPool
+	duplicatePolicy       DuplicatePolicy
+	injectClient          bool
+	maxStreamsPerClient   int
+	stats                 Stats
+	tracePropagation      bool
+	compression           string
+	callbackOptions       []grpc.DialOption
+	callbackKeepalive     keepalive.ClientParameters
+	callbackUnary         grpc.UnaryClientInterceptor
+	callbackStream        grpc.StreamClientInterceptor
+	clientIDKey           string // The metadata key that carries the client id
+	callbackOptional      bool
+	locator               ClientLocator
+	instance              string // Identifies this server to the locator, defaults to the listener's address
+	maxMessageSize        int
+	health                *health.Server // Registered on the gRPC server when serving, nil if disabled
+	reflection            bool
+	maxConnections        int
+	rateLimiter           *ipRateLimiter // nil if connections aren't rate limited
+	serverInfo            ServerInfo
+	verifyHandshake       func(ctx context.Context, conn Conn, info HandshakeInfo) error
+	rawStreamHandler      RawStreamHandler
+	authenticator         Authenticator
+	panicHandler          func(r any)
+	registerOnce          sync.Once // Registers the health and reflection services
+	events                eventBroker
+	handshakeTimeout      time.Duration
+	handoverTimeout       time.Duration
 	registerServerService func(server *Server[C], registrar grpc.ServiceRegistrar)
 	clients               *clientMap[C]
-	quicListener          *quic.Listener
 	listener              *multiListener
-	shutdown              *grpcsync.Event
+	shutdown              *grpcsync.Event // Fired when the server stops accepting connections
+	stopped               *grpcsync.Event // Fired once the gRPC server has stopped, closes all connections
+	conns                 sync.WaitGroup  // Tracks the connections being handled or rejected
+	connCount             atomic.Int64    // The number of connections being handled, see MaxConnections
+	missWarned            atomic.Bool     // Set once a client lookup missed, see logMissedLookup
 }
 
+// logger returns the Logger, or slog.Default() if it isn't set, so that a Server
+// with a nil Logger doesn't panic when logging.
+func (s *Server[C]) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
+
+// Serve accepts QUIC connections from listener and serves the embedded gRPC
+// server over them, see ServeListener.
 func (s *Server[C]) Serve(ctx context.Context, listener *quic.Listener) error {
+	return s.ServeListener(ctx, WrapQUICListener(listener))
+}
+
+// ServeListener accepts connections from listener and serves the embedded gRPC
+// server over them. It blocks until either the gRPC server stops (see
+// GracefulStop, Shutdown), ctx is done or accepting connections fails with a
+// fatal error. Once ctx is done the server is stopped with GracefulStop and
+// ctx.Err() is returned. If accepting fails, the gRPC server is stopped and the
+// accept error is returned.
+//
+// Any transport can be served by implementing Listener, NewYamuxListener serves
+// brpc over TCP for networks where QUIC is blocked.
+func (s *Server[C]) ServeListener(ctx context.Context, listener Listener) error {
 	if s.Server == nil {
 		return fmt.Errorf("server not provided")
 	}
 
+	// Accept blocks until a connection arrives, so we cancel it when the server
+	// shuts down rather than relying on the listener being closed.
+	acceptCtx, cancel := context.WithCancel(ctx)
+	// Closing a listener may also close the connections it accepted, a
+	// quic.Listener created with quic.ListenAddr closes the UDP socket that all
+	// connections share, so it must stay open until every connection has
+	// drained and been closed. A quic.Listener created on a caller's socket with
+	// NewQUICListener leaves the socket open.
 	go func() {
-		for {
-			select {
-			case <-s.shutdown.Done():
-				_ = listener.Close()
-				return
-			default:
-			}
+		<-s.shutdown.Done()
+		if s.health != nil {
+			s.health.Shutdown()
+		}
+		cancel()
+		<-s.stopped.Done()
+		s.conns.Wait()
+		s.events.close()
+		if !s.keepListenerOpen {
+			_ = listener.Close()
+		}
+	}()
+
+	s.registerServices()
+	acceptErr := make(chan error, 1)
+	go func() {
+		acceptErr <- s.acceptLoop(ctx, acceptCtx, listener)
+	}()
+	if s.health != nil {
+		s.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	}
+	// gRPC reports the multiListener's address, which would otherwise be the
+	// address of whichever client connection happens to be the oldest.
+	s.listener.setAddr(listener.Addr())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Server.Serve(s.listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case err := <-acceptErr:
+		if err == nil && ctx.Err() != nil && !s.shutdown.HasFired() {
+			s.logger().Info("context done, stopping server", "error", ctx.Err())
+			s.GracefulStop()
+			return multierr.Append(ctx.Err(), <-serveErr)
+		}
+		if err == nil {
+			return <-serveErr
+		}
+		s.logger().Error("accepting connections failed, stopping server", "error", err)
+		s.shutdown.Fire()
+		s.Server.Stop()
+		s.stopped.Fire()
+		return multierr.Append(fmt.Errorf("accepting connections: %w", err), <-serveErr)
+	}
+}
+
+// Listen creates a QUIC listener on addr using the server's QUIC configuration.
+func (s *Server[C]) Listen(addr string, tlsConfig *tls.Config) (*quic.Listener, error) {
+	return quic.ListenAddr(addr, s.tlsConfig(tlsConfig), s.quicConfig)
+}
 
-			conn, err := listener.Accept(ctx)
-			if err != nil {
-				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-					return
-				}
-				s.Logger.Error("accepting connection", "error", err)
-				continue
+// ListenPacket is like Listen, but creates the QUIC listener on a UDP socket that
+// the caller bound itself, see NewQUICListener.
+func (s *Server[C]) ListenPacket(pc net.PacketConn, tlsConfig *tls.Config) (*quic.Listener, error) {
+	return NewQUICListener(pc, s.tlsConfig(tlsConfig), s.quicConfig)
+}
+
+// ListenTransport creates a listener on addr using transport. Like Listen, it
+// requests client certificates when the server requires them.
+func (s *Server[C]) ListenTransport(transport Transport, addr string, tlsConfig *tls.Config) (Listener, error) {
+	return transport.Listen(addr, s.tlsConfig(tlsConfig))
+}
+
+// tlsConfig returns tlsConfig with the default ALPN protocol if it doesn't set
+// one, and with client certificates required if the server requires them.
+func (s *Server[C]) tlsConfig(tlsConfig *tls.Config) *tls.Config {
+	tlsConfig = withDefaultNextProtos(tlsConfig)
+	if !s.requireClientCert || tlsConfig == nil {
+		return tlsConfig
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if tlsConfig.ClientCAs == nil {
+		tlsConfig.ClientCAs = s.clientCAs
+	}
+	return tlsConfig
+}
+
+// ListenAndServe creates a QUIC listener on addr using the server's QUIC
+// configuration and serves on it, see Serve.
+func (s *Server[C]) ListenAndServe(ctx context.Context, addr string, tlsConfig *tls.Config) error {
+	listener, err := s.Listen(addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, listener)
+}
+
+// ListenAndServeTransport creates a listener on addr using transport and serves
+// on it, see ServeListener.
+func (s *Server[C]) ListenAndServeTransport(ctx context.Context, transport Transport, addr string, tlsConfig *tls.Config) error {
+	listener, err := s.ListenTransport(transport, addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	return s.ServeListener(ctx, listener)
+}
+
+// acceptLoop accepts connections until acceptCtx is done, returning nil, or until
+// the listener fails, returning the error.
+func (s *Server[C]) acceptLoop(ctx, acceptCtx context.Context, listener Listener) error {
+	for {
+		conn, err := listener.Accept(acceptCtx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || s.shutdown.HasFired() {
+				return nil
 			}
+			return err
+		}
 
-			go s.handleConnection(ctx, conn)
+		if !s.rateLimiter.allow(conn.RemoteAddr()) {
+			s.stats.ConnRejected(conn.RemoteAddr(), ErrRateLimited)
+			s.rejectAccepted(conn, ReasonRateLimited)
+			continue
 		}
+		if !s.acquireConn() {
+			s.stats.ConnRejected(conn.RemoteAddr(), ErrTooManyConnections)
+			s.rejectAccepted(conn, ReasonTooManyConnections)
+			continue
+		}
+		s.conns.Add(1)
+		go s.handleConnection(ctx, conn)
+	}
+}
+
+// rejectAccepted rejects conn with reason in the background, so that a slow
+// client can't hold up accepting. Rejections are tracked in conns like handled
+// connections, so the listener isn't closed before they finished.
+func (s *Server[C]) rejectAccepted(conn Conn, reason Reason) {
+	s.conns.Add(1)
+	go func() {
+		defer s.conns.Done()
+		_ = reject(conn, reason, "")
 	}()
+}
 
-	return s.Server.Serve(s.listener)
+// acquireConn counts a newly accepted connection against MaxConnections,
+// returning false if the server is at the limit. handleConnection releases the
+// connection once it is closed.
+func (s *Server[C]) acquireConn() bool {
+	n := s.connCount.Add(1)
+	if s.maxConnections > 0 && n > int64(s.maxConnections) {
+		s.connCount.Add(-1)
+		return false
+	}
+	return true
 }
 
-func (s *Server[C]) handleConnection(ctx context.Context, conn quic.Connection) {
+func (s *Server[C]) handleConnection(ctx context.Context, conn Conn) {
+	defer s.conns.Done()
+	defer s.connCount.Add(-1)
 	go func() {
 		select {
-		case <-s.shutdown.Done():
-			_ = conn.CloseWithError(quic.ApplicationErrorCode(100), "server shutdown")
+		case <-s.stopped.Done():
+			_ = closeWithReason(conn, ReasonShutdown)
 		case <-conn.Context().Done():
 			return
 		}
 	}()
 
-	err := s.handler(ctx, conn)
+	s.stats.ConnBegin(conn.RemoteAddr())
+	info := ConnEndInfo{RemoteAddr: conn.RemoteAddr()}
+	var bytes byteCounter
+	err := s.handler(ctx, conn, &info, &bytes)
+	info.BytesRead, info.BytesWritten, info.Err = bytes.read.Load(), bytes.written.Load(), err
+	s.stats.ConnEnd(info)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
 			return
 		}
-		s.Logger.Error("handling connection", "error", err, "type", reflect.TypeOf(err).String())
+		if errors.Is(err, ErrServerDraining) {
+			s.logger().Debug("rejected connection while draining", "remote", conn.RemoteAddr())
+			return
+		}
+		s.logger().Error("handling connection", "error", err, "type", reflect.TypeOf(err).String())
+	}
+}
+
+// rejectDraining rejects conn with ReasonDraining if the server is shutting down,
+// so that the client knows to retry another instance, and returns an error
+// wrapping ErrServerDraining.
+func (s *Server[C]) rejectDraining(conn Conn) error {
+	if !s.shutdown.HasFired() {
+		return nil
 	}
+	_ = reject(conn, ReasonDraining, "")
+	return fmt.Errorf("rejecting client: %w", ErrServerDraining)
 }
 
-func (s *Server[C]) handler(ctx context.Context, conn quic.Connection) (err error) {
+// recoverConnection recovers from a panic while handling conn, so that a bad
+// client or callback only takes down its own connection rather than the whole
+// process. The panic is turned into an error in err, which makes the handler
+// close the connection with ReasonInternal. It must be deferred directly.
+func (s *Server[C]) recoverConnection(conn Conn, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	s.logger().Error("panic handling connection", "panic", r, "remote", conn.RemoteAddr(), "stack", string(debug.Stack()))
+	*err = fmt.Errorf("panic handling connection: %v", r)
+	if s.panicHandler != nil {
+		s.panicHandler(r)
+	}
+}
+
+// handler runs the handshake for conn and then serves the client until the
+// connection is closed. info.ClientID is set once the client is registered, and
+// bytes counts the traffic on the connection's gRPC streams.
+func (s *Server[C]) handler(ctx context.Context, conn Conn, info *ConnEndInfo, bytes *byteCounter) (err error) {
+	defer func() {
+		if err != nil && info.ClientID == uuid.Nil {
+			s.stats.HandshakeFailed(conn.RemoteAddr(), err)
+		}
+	}()
 	// When this function returns, everything should be cleaned up
 	defer multierr.AppendFunc(&err, func() error {
-		return conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+		if err != nil {
+			return closeWithReason(conn, ReasonInternal)
+		}
+		return closeWithReason(conn, ReasonNormal)
 	})
+	defer s.recoverConnection(conn, &err)
+	if err := s.rejectDraining(conn); err != nil {
+		return err
+	}
 
-	id, err := sendClientID(ctx, conn)
-	if err != nil {
-		return fmt.Errorf("sending client id: %w", err)
+	// Authenticate the client before handing out an ID
+	var peerCert *x509.Certificate
+	if s.requireClientCert {
+		peerCert, err = verifyClientCertificate(conn.ConnectionState(), s.clientCAs)
+		if err != nil {
+			_ = reject(conn, ReasonAuthFailed, "")
+			return fmt.Errorf("verifying client certificate: %w", err)
+		}
 	}
 
-	// Open a connection used for server->client RPCs and create a gRPC
-	// client using that connection.
-	grpcConn, err := conn.OpenStreamSync(ctx)
+	handshakeCtx, cancel := withHandshakeTimeout(ctx, s.handshakeTimeout)
+	defer cancel()
+	handshake, err := receiveHandshake(handshakeCtx, conn)
+	if errors.Is(err, ErrProtocolVersionMismatch) {
+		_ = closeWithReason(conn, ReasonProtocolMismatch)
+	}
 	if err != nil {
-		return fmt.Errorf("opening server->client grpc connection: %w", err)
+		return fmt.Errorf("receiving handshake: %w", handshakeError(handshakeCtx, err))
+	}
+	var id uuid.UUID
+	if s.authenticator != nil {
+		id, err = s.authenticator(handshakeCtx, handshake.Token, conn.ConnectionState())
+		if err != nil {
+			_ = reject(conn, ReasonAuthFailed, err.Error())
+			return fmt.Errorf("authenticating client: %w", err)
+		}
+	}
+	if s.verifyHandshake != nil {
+		if err := s.verifyHandshake(handshakeCtx, conn, handshake); err != nil {
+			_ = reject(conn, ReasonHandshakeRejected, err.Error())
+			return fmt.Errorf("verifying handshake: %w", err)
+		}
+	}
+	if id == uuid.Nil {
+		id, err = s.clientIDFunc(handshakeCtx, conn)
+		if err != nil {
+			return fmt.Errorf("assigning client id: %w", handshakeError(handshakeCtx, err))
+		}
+	}
+	// Reject duplicates before handing out the id, so the client learns why.
+	// Registering the client below still enforces the policy if another client
+	// with the same id connects in the meantime.
+	if _, ok := s.clients.get(id); ok && s.duplicatePolicy == DuplicateReject {
+		_ = reject(conn, ReasonDuplicateClientID, "")
+		return fmt.Errorf("registering client with id %s: %w", id, ErrDuplicateClientID)
+	}
+	// The server may have started shutting down during the handshake, the
+	// client is better off connecting to another instance then.
+	if err := s.rejectDraining(conn); err != nil {
+		return err
+	}
+	serverInfo := s.serverInfo
+	if handshake.hasCapability(CapabilityBinaryClientID) {
+		serverInfo = serverInfo.withCapability(CapabilityBinaryClientID)
 	}
-	defer multierr.AppendFunc(&err, grpcConn.Close)
-	grpcClient, err := dial(grpcConn, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if s.rawStreamHandler != nil {
+		serverInfo = serverInfo.withCapability(CapabilityRawStreams)
+	}
+	err = sendClientID(handshakeCtx, conn, id, serverInfo)
 	if err != nil {
-		return fmt.Errorf("dialing client's grpc server: %w", err)
+		return fmt.Errorf("sending client id: %w", handshakeError(handshakeCtx, err))
+	}
+	// The client only opens control streams once it received its id, so from
+	// now on the peer's unidirectional streams are control streams.
+	pings := newPinger()
+	go serveControl(conn, pings, s.logger())
+
+	// Open a connection used for server->client RPCs and create a gRPC
+	// client using that connection, unless the server only serves
+	// client->server RPCs or the client doesn't serve any.
+	idle := newIdleTimer(s.idleTimeout)
+	var client C
+	var services map[any]any
+	var grpcClient *grpc.ClientConn
+	var noCallback error
+	switch {
+	case s.clientServiceBuilder == nil && s.clientServices.empty():
+		noCallback = ErrCallbackDisabled
+	case !handshake.hasCapability(CapabilityCallback):
+		noCallback = ErrClientHasNoCallbackService
+	default:
+		var grpcConn net.Conn
+		grpcClient, grpcConn, err = s.dialCallback(handshakeCtx, conn, id, idle, bytes)
+		if err != nil && !s.callbackOptional {
+			return err
+		}
+		if err != nil {
+			s.logger().Warn("client can't be called back", "id", id, "error", err)
+			noCallback = fmt.Errorf("%w: %w", ErrCallbackUnavailable, err)
+			err = nil
+			break
+		}
+		defer multierr.AppendFunc(&err, grpcConn.Close)
+		if s.clientServiceBuilder != nil {
+			client = s.clientServiceBuilder(grpcClient)
+		}
+		services = s.clientServices.build(grpcClient)
 	}
-	defer multierr.AppendFunc(&err, grpcClient.Close)
 
 	// Register this gRPC client into our client map so that when the user's
 	// gRPC service implementation receives an RPC, it can look up the clients
 	// gRPC client and connect to it.
-	err = s.clients.add(id, s.clientServiceBuilder(grpcClient))
+	entry := &clientEntry[C]{
+		client:     client,
+		services:   services,
+		conn:       grpcClient,
+		addr:       conn.RemoteAddr(),
+		idle:       idle,
+		noCallback: noCallback,
+		cert:       peerCert,
+		tls:        conn.ConnectionState(),
+		ctx:        conn.Context(),
+		handshake:  handshake,
+		close:      closeOnce(conn),
+		bytes:      bytes,
+		ping: func(ctx context.Context) error {
+			return pings.ping(ctx, conn)
+		},
+	}
+	previous, err := s.clients.add(id, entry, s.duplicatePolicy != DuplicateReject)
 	if err != nil {
-		return fmt.Errorf("registering client with id %s: %w", id, err)
+		_ = entry.close(ReasonDuplicateClientID, ReasonDuplicateClientID.String())
+		return multierr.Append(fmt.Errorf("registering client with id %s: %w", id, err), entry.closeConn())
+	}
+	// Removing the client also closes grpcClient. The entry is removed as soon
+	// as the connection is closed, and in any case once the handler returns,
+	// even if it panics, so that the map never holds entries for closed
+	// connections. remove is a no-op for entries that are already gone.
+	stopRemove := context.AfterFunc(conn.Context(), func() {
+		_ = s.clients.remove(id, entry)
+	})
+	defer multierr.AppendFunc(&err, func() error {
+		stopRemove()
+		return s.clients.remove(id, entry)
+	})
+	defer s.registerLocation(id, entry)()
+	switch {
+	case previous != nil && s.duplicatePolicy == DuplicateHandover:
+		s.logger().Info("handing over existing client with the same id", "id", id, "timeout", s.handoverTimeout)
+		go s.handOver(previous)
+	case previous != nil:
+		s.logger().Info("replacing existing client with the same id", "id", id)
+		_ = multierr.Append(previous.closeConn(), previous.close(ReasonReplaced, ReasonReplaced.String()))
+	}
+	defer s.logger().Info("client disconnected", "id", id)
+	defer s.events.publish(ClientEvent{Type: ClientEventDisconnected, ID: id, Addr: conn.RemoteAddr()})
+	info.ClientID = id
+	s.stats.ClientConnected(id, conn.RemoteAddr())
+	s.events.publish(ClientEvent{Type: ClientEventConnected, ID: id, Addr: conn.RemoteAddr()})
+	// Only start accepting the client's client->server streams now that the
+	// client is registered. The client may already have opened its stream and
+	// sent RPCs, but those wait in the transport until the stream is accepted
+	// here, so handlers never observe an unregistered client. This must stay
+	// the last step of the handshake. The server may have started shutting
+	// down while the client was being registered, in which case the client is
+	// better off connecting to another instance.
+	if err := s.rejectDraining(conn); err != nil {
+		return err
+	}
+	s.listener.AddListener(newClientListener(conn, id, bytes, s.rawStreamHandler))
+	select {
+	case <-conn.Context().Done():
+	case <-idle.expired(conn.Context()):
+		s.logger().Info("closing idle client", "id", id, "timeout", s.idleTimeout)
+		return entry.close(ReasonIdleTimeout, ReasonIdleTimeout.String())
 	}
-	defer s.clients.remove(id)
-	defer s.Logger.Info("client disconnected", "id", id)
-	s.listener.AddListener(&quicListener{conn: conn})
-	<-conn.Context().Done()
 	return nil
 }
 
+// defaultHandoverTimeout is the default ServerConfig.HandoverTimeout.
+const defaultHandoverTimeout = 10 * time.Second
+
+// handOver closes the connection of previous, a client entry that was replaced
+// with DuplicateHandover, once the client closed it or the handover timeout
+// expired.
+func (s *Server[C]) handOver(previous *clientEntry[C]) {
+	timer := time.NewTimer(s.handoverTimeout)
+	defer timer.Stop()
+	select {
+	case <-previous.ctx.Done():
+	case <-timer.C:
+	}
+	_ = multierr.Append(previous.closeConn(), previous.close(ReasonReplaced, ReasonReplaced.String()))
+}
+
+// dialCallback opens the stream for the server->client gRPC connection of the
+// client with id, and dials the client's gRPC server over it. The stream must be
+// closed once the connection is no longer needed.
+func (s *Server[C]) dialCallback(ctx context.Context, conn Conn, id uuid.UUID, idle *idleTimer, bytes *byteCounter) (*grpc.ClientConn, net.Conn, error) {
+	grpcConn, err := openTypedStream(ctx, conn, streamTypeGRPCServerToClient)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening server->client grpc connection: %w", handshakeError(ctx, err))
+	}
+	calls := &callStats{stats: s.stats, id: id}
+	identifier := callbackIdentifier{id, s.clientIDKey}
+	unary := []grpc.UnaryClientInterceptor{idle.unaryClientInterceptor, calls.unaryClientInterceptor, identifier.unaryClientInterceptor}
+	if s.callbackUnary != nil {
+		unary = append(unary, s.callbackUnary)
+	}
+	stream := []grpc.StreamClientInterceptor{idle.streamClientInterceptor, calls.streamClientInterceptor, identifier.streamClientInterceptor}
+	if s.callbackStream != nil {
+		stream = append(stream, s.callbackStream)
+	}
+	grpcClient, err := dial(bytes.wrap(grpcConn), append(s.callbackDialOptions(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(unary...),
+		grpc.WithChainStreamInterceptor(stream...))...)
+	if err != nil {
+		return nil, nil, multierr.Append(fmt.Errorf("dialing client's grpc server: %w", err), grpcConn.Close())
+	}
+	return grpcClient, grpcConn, nil
+}
+
+// callbackDialOptions returns the configurable options for the server->client
+// gRPC connections, ending with ServerConfig.CallbackDialOptions.
+func (s *Server[C]) callbackDialOptions() []grpc.DialOption {
+	options := append(compressionDialOptions(s.compression), tracingDialOptions(s.tracePropagation)...)
+	options = append(options, messageSizeDialOptions(s.maxMessageSize)...)
+	options = append(options, keepaliveDialOptions(s.callbackKeepalive)...)
+	return append(options, s.callbackOptions...)
+}
+
+// GracefulStop stops accepting new connections and blocks until all in-flight
+// RPCs have finished, after which all client connections are closed.
 func (s *Server[C]) GracefulStop() {
 	s.shutdown.Fire()
 	s.Server.GracefulStop()
+	s.stopped.Fire()
+}
+
+// Shutdown is like GracefulStop, but only waits for in-flight RPCs until ctx is
+// done. If ctx expires before the server has drained, the gRPC server is stopped
+// forcefully, all client connections are closed and an error wrapping
+// ErrForcedShutdown is returned. A nil error means the server drained cleanly.
+func (s *Server[C]) Shutdown(ctx context.Context) error {
+	s.shutdown.Fire()
+	drained := make(chan struct{})
+	go func() {
+		s.Server.GracefulStop()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		s.stopped.Fire()
+		return nil
+	case <-ctx.Done():
+		s.Server.Stop()
+		s.stopped.Fire()
+		return fmt.Errorf("%w: %w", ErrForcedShutdown, ctx.Err())
+	}
 }
 
 // ServerConfig allows you to configure the server. It is generic over S (the gRPC service
@@ -141,42 +619,595 @@ type ServerConfig[C any] struct {
 	//
 	// 		ClientServiceBuilder: example.NewClientServiceClient
 	//
+	// Leave it nil to only serve client->server RPCs: the server still assigns
+	// IDs during the handshake, but doesn't open a server->client connection, and
+	// ClientFromContext and friends fail with ErrCallbackDisabled, unless client
+	// services were registered with RegisterClientService. Such a server
+	// pairs well with clients dialed WithoutCallback. Likewise, the server
+	// doesn't open a server->client connection to clients that were dialed
+	// WithoutCallback, and ClientFromContext fails with
+	// ErrClientHasNoCallbackService for them.
 	ClientServiceBuilder func(cc grpc.ClientConnInterface) C
 
-	// The gRPC server that we should forward RPC requests to
+	// The gRPC server that we should forward RPC requests to. If nil, NewServer
+	// builds one with the options from Server.ServerOptions followed by
+	// GRPCServerOptions, register services on the Server field afterwards.
 	Server *grpc.Server
+
+	// GRPCServerOptions are appended to the options of the gRPC server that
+	// NewServer builds when Server is nil. They have no effect otherwise.
+	GRPCServerOptions []grpc.ServerOption
+
+	// ClientIDFunc assigns an ID to each newly accepted connection. The ID is sent
+	// to the client during the handshake and used to route server->client RPCs. If
+	// an error is returned, the connection is closed. Defaults to a random UUID.
+	ClientIDFunc ClientIDFunc
+
+	// KeepListenerOpen stops the server from closing the listener passed to Serve
+	// when it shuts down. By default the server owns the listener and closes it,
+	// set this if the listener is shared or will be served again afterwards.
+	KeepListenerOpen bool
+
+	// IdleTimeout closes a client's connection with ReasonIdleTimeout if neither a
+	// client->server nor a server->client RPC happened within the timeout. Zero
+	// disables the idle timeout. Client->server RPCs are only observed if the
+	// interceptors from Server.ServerOptions are installed on the gRPC server.
+	IdleTimeout time.Duration
+
+	// QUICConfig is used by Server.Listen and Server.ListenAndServe to create the
+	// QUIC listener. It has no effect on listeners passed directly to Serve.
+	QUICConfig *quic.Config
+
+	// KeepAlive enables QUIC keep-alives at the provided period on listeners created
+	// by the server, overriding QUICConfig.KeepAlivePeriod. The idle timeout is
+	// raised to three periods if QUICConfig doesn't set one.
+	KeepAlive time.Duration
+
+	// RequireClientCert enables mutual TLS. Clients must present a certificate that
+	// verifies against ClientCAs, otherwise their connection is closed with
+	// ReasonAuthFailed before they are assigned an ID. Listeners created by
+	// Server.Listen are configured to request and verify client certificates, for
+	// listeners passed directly to Serve, the TLS config must at least request one.
+	RequireClientCert bool
+	ClientCAs         *x509.CertPool
+
+	// OnDuplicateClientID decides what happens when a client is assigned an ID that
+	// belongs to a client that is still connected, for example when a client with a
+	// certificate-derived ID reconnects before its old connection timed out.
+	// Defaults to DuplicateReject.
+	OnDuplicateClientID DuplicatePolicy
+
+	// HandoverTimeout is how long the previous connection of a client stays open
+	// after a new connection took over its ID with DuplicateHandover. Defaults to
+	// 10s.
+	HandoverTimeout time.Duration
+
+	// HandshakeTimeout bounds how long a newly accepted connection may take to
+	// complete the brpc handshake. Connections that exceed it are closed, so that
+	// a stuck or malicious client can't pin server resources. Defaults to 10s.
+	HandshakeTimeout time.Duration
+
+	// OnStreamAcceptError is called when accepting client->server streams from a
+	// client's connection fails with something other than the connection being
+	// closed. The server stops accepting streams from that client but keeps
+	// serving all other clients.
+	OnStreamAcceptError func(err error)
+
+	// InjectClient makes the interceptors from Server.ServerOptions resolve the
+	// calling client before the handler runs, so handlers can retrieve it with
+	// ClientFromContextTyped. RPCs from clients that can't be resolved are
+	// rejected with the same status codes as ClientFromContext returns.
+	InjectClient bool
+
+	// MaxConcurrentStreamsPerClient limits how many client->server RPCs a single
+	// client may have in flight, RPCs over the limit are rejected with
+	// codes.ResourceExhausted. Zero means no limit. The limit is enforced by the
+	// interceptors from Server.ServerOptions.
+	MaxConcurrentStreamsPerClient int
+
+	// Stats receives connection-level events, such as connections being accepted
+	// and failing the handshake, for exporting metrics. Defaults to NopStats.
+	Stats Stats
+
+	// TracePropagation instruments server->client RPCs and, through
+	// Server.ServerOptions, client->server RPCs with OpenTelemetry, using the
+	// global tracer provider and propagator. Combined with WithTracePropagation
+	// on the client, a single trace spans the whole client->server->client hop.
+	TracePropagation bool
+
+	// DefaultCompression compresses all server->client RPCs with the named
+	// compressor, for example "gzip", unless a call overrides it with
+	// grpc.UseCompressor. The compressor must be registered with the
+	// google.golang.org/grpc/encoding package, gzip is always registered.
+	// Compression of client->server RPCs is chosen by the client, see
+	// WithDefaultCompression.
+	DefaultCompression string
+
+	// CallbackDialOptions are appended to the options that the server->client
+	// gRPC connections are dialed with, for example to add interceptors or raise
+	// the maximum message size with grpc.WithDefaultCallOptions. Options that
+	// replace the transport, such as grpc.WithContextDialer, must not be used.
+	CallbackDialOptions []grpc.DialOption
+
+	// CallbackUnaryInterceptor and CallbackStreamInterceptor intercept every
+	// server->client RPC, for example to record the latency and status of each
+	// call per method. Unlike interceptors added with CallbackDialOptions, they
+	// run last, so the client id is already in the call's outgoing metadata, and
+	// CallbackTargetID returns it.
+	CallbackUnaryInterceptor  grpc.UnaryClientInterceptor
+	CallbackStreamInterceptor grpc.StreamClientInterceptor
+
+	// CallbackKeepalive makes the server->client gRPC connections send gRPC
+	// keepalive pings, so that server->client RPCs fail instead of hanging when
+	// the client application stops responding. QUIC keep-alives (see KeepAlive)
+	// only keep the connection itself alive, they don't detect a client whose
+	// process is stuck while its network stack still answers. Zero Time disables
+	// the pings, gRPC raises Time to at least 10s. Clients accept the pings since
+	// callbacks are served with a matching enforcement policy.
+	CallbackKeepalive keepalive.ClientParameters
+
+	// ClientIDMetadataKey replaces DefaultClientIDMetadataKey as the gRPC metadata
+	// key that carries the client id, for example when a proxy strips the default
+	// header or when brpc connections are nested. Clients must be dialed with the
+	// same key using WithClientIDMetadataKey, otherwise the server can't find
+	// their id and ClientFromContext fails with ErrMissingClientID, which clients
+	// receive as codes.InvalidArgument. Keys are case-insensitive.
+	ClientIDMetadataKey string
+
+	// ClientLocator records which server instance each client is connected to,
+	// so that handlers can find clients connected to other instances with
+	// Server.LocateClient. Defaults to a MemoryClientLocator, which only knows
+	// the clients of this process.
+	ClientLocator ClientLocator
+
+	// TolerateCallbackFailure keeps clients connected for client->server RPCs
+	// when the server->client connection can't be established, for example
+	// because the client can't accept another stream. Handlers then get
+	// ErrCallbackUnavailable from ClientFromContext and friends for such clients.
+	// By default, the connection is closed.
+	TolerateCallbackFailure bool
+
+	// InstanceAddress identifies this server to the ClientLocator, typically an
+	// address that other instances can reach it on to forward calls. Defaults to
+	// the address that the server listens on.
+	InstanceAddress string
+
+	// MaxMessageSize raises or lowers gRPC's default 4MB limit on the size of
+	// messages in both directions. It applies to server->client RPCs, and to
+	// client->server RPCs if the gRPC server is built with Server.ServerOptions.
+	// Zero keeps the gRPC defaults. Large messages still have to fit through
+	// the transport's flow control windows, raise QUICConfig's
+	// MaxStreamReceiveWindow (or the yamux MaxStreamWindowSize) as well to
+	// avoid them being throttled.
+	MaxMessageSize int
+
+	// EnableHealthService registers the standard gRPC health service
+	// (grpc.health.v1.Health) on the gRPC server when it is served, so that
+	// monitoring can probe the server through a brpc connection. The overall
+	// status is NOT_SERVING until the server accepts connections, and again once
+	// it shuts down. See Server.HealthServer to report individual services.
+	EnableHealthService bool
+
+	// EnableReflection registers the gRPC server reflection service when the
+	// server is served, so tools like grpcurl can list and describe services.
+	// Those tools can't perform the brpc handshake, so to reach the service,
+	// additionally serve the same gRPC server on a plain listener, for example
+	// go server.Server.Serve(tcpListener) on a port only reachable while
+	// debugging. Handlers that need the calling client fail for such RPCs.
+	EnableReflection bool
+
+	// MaxConnections limits how many connections the server handles at once,
+	// including connections that are still in the handshake. Connections
+	// accepted while at the limit are closed right away with
+	// ReasonTooManyConnections and reported to Stats.ConnRejected. Zero means no
+	// limit.
+	MaxConnections int
+
+	// ConnectionRatePerIP limits how many connections per second the server
+	// accepts from each remote IP, averaged over time, with bursts of up to
+	// ConnectionBurstPerIP connections (at least one). Connections over the limit
+	// are closed before the handshake with ReasonRateLimited and reported to
+	// Stats.ConnRejected. Zero disables rate limiting.
+	ConnectionRatePerIP  float64
+	ConnectionBurstPerIP int
+
+	// ServerInfo is sent to every client along with its ID, see
+	// ClientConn.ServerInfo.
+	ServerInfo ServerInfo
+
+	// VerifyHandshake is called with the HandshakeInfo that a client sent when
+	// connecting, before it is assigned an ID. If it returns an error, the
+	// connection is closed with ReasonHandshakeRejected and the error's message,
+	// which the client sees when dialing fails. See Server.ClientHandshakeInfo
+	// to read the info of connected clients.
+	VerifyHandshake func(ctx context.Context, conn Conn, info HandshakeInfo) error
+
+	// RawStreamHandler is called in its own goroutine for every raw byte stream
+	// that a client opens with ClientConn.OpenRawStream, for example to receive
+	// files or tunnel another protocol next to the gRPC calls. The stream is
+	// closed once the handler returns. Without a handler, clients can't open raw
+	// streams.
+	RawStreamHandler RawStreamHandler
+
+	// Authenticator verifies the token that a client sent with WithToken during
+	// the handshake, before VerifyHandshake and before the client is assigned an
+	// ID. If it fails, the connection is closed with ReasonAuthFailed and dialing
+	// fails with an error that wraps ErrAuthenticationFailed and carries
+	// codes.PermissionDenied. A non-nil ID that it returns is assigned to the
+	// client instead of the one from ClientIDFunc.
+	Authenticator Authenticator
+
+	// PanicHandler is called with the recovered value when handling a connection
+	// panics, for example in the handshake or in a callback such as
+	// ClientIDFunc. The panic is always logged and only the connection is closed,
+	// with ReasonInternal, so a single bad client can't crash the server. Panics
+	// in gRPC handlers are not recovered, use a gRPC interceptor for those.
+	PanicHandler func(r any)
 }
 
+// Authenticator verifies a client's token, see ServerConfig.Authenticator. It
+// may derive the client's ID from the token, or return uuid.Nil to have the ID
+// assigned by the ServerConfig.ClientIDFunc.
+type Authenticator func(ctx context.Context, token string, state tls.ConnectionState) (uuid.UUID, error)
+
+// DuplicatePolicy decides how the server handles a client connecting with an ID
+// that is already in use.
+type DuplicatePolicy int
+
+const (
+	// DuplicateReject closes the new connection with ReasonDuplicateClientID.
+	DuplicateReject DuplicatePolicy = iota
+	// DuplicateReplace closes the existing connection with ReasonReplaced and
+	// routes all future server->client RPCs for the ID to the new connection.
+	DuplicateReplace
+	// DuplicateHandover routes all future server->client RPCs for the ID to the
+	// new connection once it is ready, like DuplicateReplace, but keeps the
+	// existing connection open until the client closes it or HandoverTimeout
+	// expires, and only then closes it with ReasonReplaced. Until the new
+	// connection is ready, server->client RPCs keep going to the existing one,
+	// and RPCs in flight on it in either direction can finish, which avoids
+	// errors during rolling restarts of clients with stable IDs.
+	DuplicateHandover
+)
+
+// ClientIDFunc returns the ID that should be assigned to the client on conn.
+type ClientIDFunc func(ctx context.Context, conn Conn) (uuid.UUID, error)
+
 // NewServer constructs
 func NewServer[C any](config ServerConfig[C]) *Server[C] {
-	return &Server[C]{
+	if config.ClientIDFunc == nil {
+		config.ClientIDFunc = newClientID
+	}
+	if config.Stats == nil {
+		config.Stats = NopStats{}
+	}
+	if config.ClientLocator == nil {
+		config.ClientLocator = NewMemoryClientLocator()
+	}
+	if config.HandoverTimeout <= 0 {
+		config.HandoverTimeout = defaultHandoverTimeout
+	}
+	s := &Server[C]{
 		Logger:               slog.Default(),
 		Server:               config.Server,
 		clients:              newClientMap[C](),
 		clientServiceBuilder: config.ClientServiceBuilder,
+		clientServices:       newClientServices(),
+		clientIDFunc:         config.ClientIDFunc,
+		keepListenerOpen:     config.KeepListenerOpen,
+		idleTimeout:          config.IdleTimeout,
+		quicConfig:           withKeepAlive(config.QUICConfig, config.KeepAlive),
+		requireClientCert:    config.RequireClientCert,
+		clientCAs:            config.ClientCAs,
+		duplicatePolicy:      config.OnDuplicateClientID,
+		injectClient:         config.InjectClient,
+		maxStreamsPerClient:  config.MaxConcurrentStreamsPerClient,
+		stats:                config.Stats,
+		tracePropagation:     config.TracePropagation,
+		compression:          config.DefaultCompression,
+		callbackOptions:      config.CallbackDialOptions,
+		callbackKeepalive:    config.CallbackKeepalive,
+		callbackUnary:        config.CallbackUnaryInterceptor,
+		callbackStream:       config.CallbackStreamInterceptor,
+		clientIDKey:          clientIDMetadataKey(config.ClientIDMetadataKey),
+		locator:              config.ClientLocator,
+		callbackOptional:     config.TolerateCallbackFailure,
+		instance:             config.InstanceAddress,
+		maxMessageSize:       config.MaxMessageSize,
+		handshakeTimeout:     config.HandshakeTimeout,
+		handoverTimeout:      config.HandoverTimeout,
+		reflection:           config.EnableReflection,
+		maxConnections:       config.MaxConnections,
+		rateLimiter:          newIPRateLimiter(config.ConnectionRatePerIP, config.ConnectionBurstPerIP),
+		serverInfo:           config.ServerInfo,
+		verifyHandshake:      config.VerifyHandshake,
+		rawStreamHandler:     config.RawStreamHandler,
+		authenticator:        config.Authenticator,
+		panicHandler:         config.PanicHandler,
 		listener:             newMultiListener(),
 		shutdown:             grpcsync.NewEvent(),
+		stopped:              grpcsync.NewEvent(),
+	}
+	if s.Server == nil {
+		s.Server = grpc.NewServer(append(s.ServerOptions(), config.GRPCServerOptions...)...)
 	}
+	if config.EnableHealthService {
+		s.health = health.NewServer()
+		s.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	s.listener.onError = func(_ net.Listener, err error) {
+		s.logger().Warn("accepting client->server stream", "error", err)
+		if config.OnStreamAcceptError != nil {
+			config.OnStreamAcceptError(err)
+		}
+	}
+	return s
 }
 
-// ClientFromContext returns a client
+// ClientFromContext returns the client service stub for the client that made the
+// RPC in ctx. Returned errors carry a gRPC status code, so they can be returned
+// from the handler as is, and can be matched against ErrMissingMetadata,
+// ErrMissingClientID, ErrInvalidClientID, ErrMultipleClientIDs,
+// ErrClientIDMismatch and ErrClientNotConnected with errors.Is.
+//
+// Call the stub with the handler's ctx. gRPC then sends the remaining time of
+// the incoming deadline along with the server->client RPC, so a slow client
+// can't exceed the original caller's budget, and the callback is cancelled
+// along with the handler.
 func (s *Server[C]) ClientFromContext(ctx context.Context) (client C, err error) {
+	entry, err := s.entryFromContext(ctx)
+	if err != nil {
+		return client, err
+	}
+	if err := entry.callbackErr(); err != nil {
+		return client, err
+	}
+	return entry.client, nil
+}
+
+// ClientConnFromContext returns the raw server->client connection for the client
+// that made the RPC in ctx. It can be used to construct stubs for any gRPC service
+// the client serves, not just C.
+func (s *Server[C]) ClientConnFromContext(ctx context.Context) (grpc.ClientConnInterface, error) {
+	entry, err := s.entryFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := entry.callbackErr(); err != nil {
+		return nil, err
+	}
+	return entry.conn, nil
+}
+
+// ClientFromContextAs is like Server.ClientFromContext, but builds a stub of type T
+// for the calling client using builder, which is typically a constructor generated
+// by protoc. Use this when clients serve more than one service.
+//
+//	namer, err := brpc.ClientFromContextAs(ctx, server, example.NewNamerClient)
+func ClientFromContextAs[T, C any](ctx context.Context, s *Server[C], builder func(cc grpc.ClientConnInterface) T) (client T, err error) {
+	conn, err := s.ClientConnFromContext(ctx)
+	if err != nil {
+		return client, err
+	}
+	return builder(conn), nil
+}
+
+func (s *Server[C]) entryFromContext(ctx context.Context) (*clientEntry[C], error) {
+	if entry, ok := ctx.Value(clientEntryKey[C]{}).(*clientEntry[C]); ok {
+		return entry, nil
+	}
+	id, err := s.callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := s.clients.get(id)
+	if !ok {
+		s.logMissedLookup(id)
+		return nil, newStatusError(codes.NotFound, ErrClientNotConnected)
+	}
+	s.logger().Debug("getting client", "id", id)
+	return entry, nil
+}
+
+// maxLoggedClientIDs caps the number of connected client ids that are logged
+// when looking up a client fails.
+const maxLoggedClientIDs = 10
+
+// logMissedLookup logs that the client with id isn't connected, along with some
+// of the clients that are. Only the first miss is logged as a warning, since
+// misses are usually caused by misconfiguration and would otherwise flood the
+// log, later ones are logged at debug level.
+func (s *Server[C]) logMissedLookup(id uuid.UUID) {
+	level := slog.LevelDebug
+	if s.missWarned.CompareAndSwap(false, true) {
+		level = slog.LevelWarn
+	}
+	if !s.logger().Enabled(context.Background(), level) {
+		return
+	}
+	connected, total := s.clients.ids(maxLoggedClientIDs)
+	s.logger().Log(context.Background(), level, "client not connected", "id", id, "connected", connected, "total", total)
+}
+
+// callerID returns the id of the client that made the RPC in ctx. Clients dialed
+// WithoutCallback don't send their id, but RPCs that arrived over a brpc
+// connection can still be attributed to it.
+func (s *Server[C]) callerID(ctx context.Context) (uuid.UUID, error) {
+	id, err := clientIDFromContext(ctx, s.clientIDKey)
+	if errors.Is(err, ErrMissingMetadata) || errors.Is(err, ErrMissingClientID) {
+		if peerID, ok := peerClientID(ctx); ok {
+			return peerID, nil
+		}
+	}
+	return id, err
+}
+
+// clientIDFromContext returns the client id from the incoming metadata in ctx,
+// stored under key.
+func clientIDFromContext(ctx context.Context, key string) (uuid.UUID, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return client, status.Error(codes.InvalidArgument, "metadata not provided")
+		return uuid.Nil, newStatusError(codes.InvalidArgument, ErrMissingMetadata)
+	}
+	ids, binaryIDs := md.Get(key), md.Get(binaryMetadataKey(key))
+	if len(ids)+len(binaryIDs) == 0 {
+		return uuid.Nil, newStatusError(codes.InvalidArgument, ErrMissingClientID)
+	}
+	if len(ids)+len(binaryIDs) > 1 {
+		return uuid.Nil, newStatusError(codes.InvalidArgument, ErrMultipleClientIDs)
 	}
-	ids := md.Get(metadataClientIDKey)
-	if len(ids) == 0 {
-		return client, status.Error(codes.InvalidArgument, "client id not provided")
+	var id uuid.UUID
+	var err error
+	if len(binaryIDs) > 0 {
+		id, err = uuid.FromBytes([]byte(binaryIDs[0]))
+	} else {
+		id, err = uuid.Parse(ids[0])
 	}
-	id, err := uuid.Parse(ids[0])
 	if err != nil {
-		return client, status.Error(codes.InvalidArgument, "invalid client id")
+		return uuid.Nil, newStatusError(codes.InvalidArgument, ErrInvalidClientID)
+	}
+	// RPCs that arrived over a brpc connection may only use the id assigned to
+	// that connection, otherwise a client could route calls to another client.
+	if peerID, ok := peerClientID(ctx); ok && peerID != id {
+		return uuid.Nil, newStatusError(codes.PermissionDenied, ErrClientIDMismatch)
+	}
+	return id, nil
+}
+
+// peerClientID returns the id of the client whose brpc connection the RPC in ctx
+// arrived over, or false if it didn't arrive over one.
+func peerClientID(ctx context.Context) (uuid.UUID, bool) {
+	if p, ok := peer.FromContext(ctx); ok {
+		if addr, ok := p.Addr.(*clientAddr); ok {
+			return addr.id, true
+		}
+	}
+	return uuid.Nil, false
+}
+
+// Client returns the client service stub for the client with the provided id, or
+// false if no such client is connected or the server can't call it.
+func (s *Server[C]) Client(id uuid.UUID) (client C, ok bool) {
+	entry, ok := s.clients.get(id)
+	if !ok || entry.callbackErr() != nil {
+		return client, false
 	}
-	s.Logger.Info("getting client", "id", id)
-	client, ok = s.clients.get(id)
+	return entry.client, true
+}
+
+// ClientBytes returns the number of bytes received from (in) and sent to (out) the
+// client with the provided id over its gRPC streams in both directions, since the
+// client connected, or false if no such client is connected. The counts include
+// gRPC framing, but not the transport's own overhead such as QUIC headers, which
+// makes them suitable for metering per client.
+func (s *Server[C]) ClientBytes(id uuid.UUID) (in, out uint64, ok bool) {
+	entry, ok := s.clients.get(id)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(entry.bytes.read.Load()), uint64(entry.bytes.written.Load()), true
+}
+
+// WaitForClient returns the client service stub for the client with the provided
+// id, waiting for the client to connect if it isn't connected yet. It fails if ctx
+// is done or the server shuts down before the client connects.
+func (s *Server[C]) WaitForClient(ctx context.Context, id uuid.UUID) (client C, err error) {
+	done, finished := make(chan struct{}), make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.shutdown.Done():
+		case <-finished:
+			return
+		}
+		close(done)
+	}()
+	entry, ok := s.clients.wait(done, id)
+	if !ok {
+		if ctx.Err() != nil {
+			return client, fmt.Errorf("waiting for client %s: %w", id, ctx.Err())
+		}
+		return client, fmt.Errorf("waiting for client %s: %w", id, ErrClientNotConnected)
+	}
+	if err := entry.callbackErr(); err != nil {
+		return client, fmt.Errorf("waiting for client %s: %w", id, err)
+	}
+	return entry.client, nil
+}
+
+// ClientConn returns the raw server->client gRPC connection for the client with
+// the provided id, or false if no such client is connected or the server can't
+// call it. The connection is closed by the server when the client disconnects.
+func (s *Server[C]) ClientConn(id uuid.UUID) (*grpc.ClientConn, bool) {
+	entry, ok := s.clients.get(id)
+	if !ok || entry.callbackErr() != nil {
+		return nil, false
+	}
+	return entry.conn, true
+}
+
+// ClientHandshakeInfo returns the HandshakeInfo that the client with the provided
+// id sent when it connected, or false if no such client is connected.
+func (s *Server[C]) ClientHandshakeInfo(id uuid.UUID) (HandshakeInfo, bool) {
+	entry, ok := s.clients.get(id)
+	if !ok {
+		return HandshakeInfo{}, false
+	}
+	return entry.handshake, true
+}
+
+// ClientHandshakeInfoFromContext returns the HandshakeInfo of the client that
+// made the RPC in ctx, see ClientHandshakeInfo.
+func (s *Server[C]) ClientHandshakeInfoFromContext(ctx context.Context) (HandshakeInfo, error) {
+	entry, err := s.entryFromContext(ctx)
+	if err != nil {
+		return HandshakeInfo{}, err
+	}
+	return entry.handshake, nil
+}
+
+// PingClient measures the round-trip time to the client with the provided id. The
+// ping is sent over the client's raw connection, below gRPC, and the client
+// answers it on a stream of its own, so a successful ping shows that the
+// connection works in both directions. It returns ErrClientNotConnected if no
+// such client is connected.
+func (s *Server[C]) PingClient(ctx context.Context, id uuid.UUID) (time.Duration, error) {
+	entry, ok := s.clients.get(id)
+	if !ok {
+		return 0, fmt.Errorf("pinging client %s: %w", id, ErrClientNotConnected)
+	}
+	start := time.Now()
+	if err := entry.ping(ctx); err != nil {
+		return 0, fmt.Errorf("pinging client %s: %w", id, err)
+	}
+	return time.Since(start), nil
+}
+
+// DisconnectClient forcibly closes the connection of the client with the provided
+// id, for example to kick a misbehaving client. The client sees the connection
+// closed with ReasonDisconnected and reason as the message, and any RPCs in
+// flight in either direction are cancelled. If the client reconnects, it gets a
+// new connection like any other client. Returns ErrClientNotConnected if no such
+// client is connected.
+func (s *Server[C]) DisconnectClient(id uuid.UUID, reason string) error {
+	entry, ok := s.clients.get(id)
+	if !ok {
+		return fmt.Errorf("disconnecting client %s: %w", id, ErrClientNotConnected)
+	}
+	s.logger().Info("disconnecting client", "id", id, "reason", reason)
+	if reason == "" {
+		reason = ReasonDisconnected.String()
+	}
+	return multierr.Append(s.clients.remove(id, entry), entry.close(ReasonDisconnected, reason))
+}
+
+// ClientAddr returns the remote address that the client with the provided id
+// connected from, or false if no such client is connected.
+func (s *Server[C]) ClientAddr(id uuid.UUID) (net.Addr, bool) {
+	entry, ok := s.clients.get(id)
 	if !ok {
-		return client, status.Error(codes.NotFound, "client not found")
+		return nil, false
 	}
-	return client, nil
+	return entry.addr, true
 }
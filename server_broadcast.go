@@ -0,0 +1,154 @@
+package brpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"go.uber.org/multierr"
+	"sync"
+	"time"
+)
+
+// SetClientTag attaches a key/value tag to a connected client. Tags can be used to
+// select clients when broadcasting, and are discarded when the client disconnects.
+// Setting a tag on a client that isn't connected has no effect.
+func (s *Server[C]) SetClientTag(id uuid.UUID, key, value string) {
+	s.clients.setTag(id, key, value)
+}
+
+// GetClientTags returns a copy of the tags attached to a client, or nil if the
+// client isn't connected.
+func (s *Server[C]) GetClientTags(id uuid.UUID) map[string]string {
+	tags, _ := s.clients.tags(id)
+	return tags
+}
+
+// BroadcastFunc is called once per client when broadcasting.
+type BroadcastFunc[C any] func(ctx context.Context, id uuid.UUID, client C) error
+
+// BroadcastConfig bounds the resources that a broadcast uses when fanning out
+// to many clients, see BroadcastWithConfig.
+type BroadcastConfig struct {
+	// Concurrency is the maximum number of calls to the BroadcastFunc that are
+	// outstanding at the same time. Once the limit is reached, the broadcast
+	// waits for a call to return before calling the next client, so that slow
+	// clients don't pile up memory. Zero means no limit.
+	Concurrency int
+
+	// PerCallTimeout, if set, bounds the context passed to each call.
+	PerCallTimeout time.Duration
+
+	// ContinueOnError calls the remaining clients after a call failed. If
+	// false, the broadcast stops calling further clients after the first
+	// error, waits for the outstanding calls and reports the clients that
+	// weren't called as skipped.
+	ContinueOnError bool
+}
+
+// BroadcastResult reports the outcome of a broadcast per client.
+type BroadcastResult struct {
+	Succeeded []uuid.UUID
+	Failed    map[uuid.UUID]error
+	// Skipped are the clients that weren't called, because the broadcast was
+	// stopped after an error or ctx was done.
+	Skipped []uuid.UUID
+}
+
+// Broadcast concurrently calls fn for every connected client and returns the
+// combined errors of all calls.
+func (s *Server[C]) Broadcast(ctx context.Context, fn BroadcastFunc[C]) error {
+	return s.BroadcastMatching(ctx, nil, fn)
+}
+
+// BroadcastMatching is like Broadcast, but only calls fn for the clients whose
+// tags satisfy match. A nil match selects all clients.
+func (s *Server[C]) BroadcastMatching(ctx context.Context, match func(tags map[string]string) bool, fn BroadcastFunc[C]) error {
+	_, err := s.BroadcastWithConfig(ctx, BroadcastConfig{ContinueOnError: true}, match, fn)
+	return err
+}
+
+// BroadcastWithConfig is like BroadcastMatching, but limits the outstanding calls
+// and the duration of each call according to config. It returns the partial
+// results along with the combined errors of all calls, which include ctx's
+// error if ctx was done before every client was called.
+func (s *Server[C]) BroadcastWithConfig(ctx context.Context, config BroadcastConfig, match func(tags map[string]string) bool, fn BroadcastFunc[C]) (BroadcastResult, error) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		errs    error
+		stopped bool
+		result  = BroadcastResult{Failed: make(map[uuid.UUID]error)}
+	)
+	var sem chan struct{}
+	if config.Concurrency > 0 {
+		sem = make(chan struct{}, config.Concurrency)
+	}
+	call := func(c clientSnapshot[C]) {
+		defer wg.Done()
+		if sem != nil {
+			defer func() { <-sem }()
+		}
+		callCtx := ctx
+		if config.PerCallTimeout > 0 {
+			var cancel context.CancelFunc
+			callCtx, cancel = context.WithTimeout(ctx, config.PerCallTimeout)
+			defer cancel()
+		}
+		err := fn(callCtx, c.id, c.client)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			result.Failed[c.id] = err
+			errs = multierr.Append(errs, fmt.Errorf("client %s: %w", c.id, err))
+			stopped = stopped || !config.ContinueOnError
+			return
+		}
+		result.Succeeded = append(result.Succeeded, c.id)
+	}
+	for _, c := range s.clients.snapshot() {
+		if match != nil && !match(c.tags) {
+			continue
+		}
+		if !acquireBroadcastSlot(ctx, sem) {
+			mu.Lock()
+			if !stopped {
+				stopped = true
+				errs = multierr.Append(errs, ctx.Err())
+			}
+			result.Skipped = append(result.Skipped, c.id)
+			mu.Unlock()
+			continue
+		}
+		mu.Lock()
+		if stopped {
+			result.Skipped = append(result.Skipped, c.id)
+			mu.Unlock()
+			if sem != nil {
+				<-sem
+			}
+			continue
+		}
+		mu.Unlock()
+		wg.Add(1)
+		go call(c)
+	}
+	wg.Wait()
+	return result, errs
+}
+
+// acquireBroadcastSlot waits for a free slot in sem, a nil sem has unlimited
+// slots. Returns false if ctx is done first.
+func acquireBroadcastSlot(ctx context.Context, sem chan struct{}) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if sem == nil {
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
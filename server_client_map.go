@@ -1,41 +1,216 @@
 package brpc
 
 import (
-	"errors"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"net"
 	"sync"
+	"sync/atomic"
 )
 
+// clientEntry holds everything the server knows about a single connected client.
+type clientEntry[ClientService any] struct {
+	client     ClientService
+	services   map[any]any                     // The stubs of the services registered with RegisterClientService, by clientServiceKey
+	conn       *grpc.ClientConn                // The server->client connection that client was built from, owned by the entry, nil if noCallback is set
+	noCallback error                           // Why the server can't call the client, if it can't
+	addr       net.Addr                        // The remote address of the client's connection
+	tags       map[string]string               // Arbitrary user-provided tags, guarded by the clientMap lock
+	idle       *idleTimer                      // Tracks RPC activity for the idle timeout
+	cert       *x509.Certificate               // The verified client certificate when using mutual TLS
+	tls        tls.ConnectionState             // The TLS state of the client's connection, zero without TLS
+	ctx        context.Context                 // The context of the client's connection, done once it is closed
+	handshake  HandshakeInfo                   // Sent by the client when it connected
+	close      func(Reason, string) error      // Closes the client's underlying connection, only the first call has an effect
+	ping       func(ctx context.Context) error // Pings the client over its underlying connection
+	bytes      *byteCounter                    // Counts the traffic on the client's gRPC streams
+
+	streams atomic.Int64 // The number of in-flight client->server RPCs
+}
+
+// callbackErr returns an error if the server can't make server->client RPCs to
+// the client, because the server has no client services, the client doesn't
+// serve any, or the server->client connection couldn't be established.
+func (e *clientEntry[ClientService]) callbackErr() error {
+	if e.noCallback != nil {
+		return newStatusError(codes.FailedPrecondition, e.noCallback)
+	}
+	return nil
+}
+
+// closeConn closes the server->client connection, if there is one.
+func (e *clientEntry[ClientService]) closeConn() error {
+	if e.conn == nil {
+		return nil
+	}
+	return e.conn.Close()
+}
+
 type clientMap[ClientService any] struct {
-	clients     map[uuid.UUID]ClientService
+	clients     map[uuid.UUID]*clientEntry[ClientService]
+	waiters     map[uuid.UUID][]chan *clientEntry[ClientService] // Notified when the id is added
 	clientsLock sync.RWMutex
 }
 
-func (c *clientMap[ClientService]) add(id uuid.UUID, client ClientService) error {
+// add registers entry under id. If a client with the same id already exists, add
+// either fails with ErrDuplicateClientID, or if replace is true, swaps in the new
+// entry and returns the previous one, which the caller is responsible for closing.
+func (c *clientMap[ClientService]) add(id uuid.UUID, entry *clientEntry[ClientService], replace bool) (*clientEntry[ClientService], error) {
 	c.clientsLock.Lock()
 	defer c.clientsLock.Unlock()
-	if _, ok := c.clients[id]; ok {
-		return errors.New("client already exists")
+	previous, ok := c.clients[id]
+	if ok && !replace {
+		return nil, ErrDuplicateClientID
 	}
-	c.clients[id] = client
-	return nil
+	c.clients[id] = entry
+	for _, waiter := range c.waiters[id] {
+		waiter <- entry
+	}
+	delete(c.waiters, id)
+	return previous, nil
 }
 
-func (c *clientMap[ClientService]) remove(id uuid.UUID) {
+// wait returns the entry registered under id, waiting for it to be added if it
+// isn't yet. It returns false if done is closed first.
+func (c *clientMap[ClientService]) wait(done <-chan struct{}, id uuid.UUID) (*clientEntry[ClientService], bool) {
+	c.clientsLock.Lock()
+	if entry, ok := c.clients[id]; ok {
+		c.clientsLock.Unlock()
+		return entry, true
+	}
+	waiter := make(chan *clientEntry[ClientService], 1)
+	c.waiters[id] = append(c.waiters[id], waiter)
+	c.clientsLock.Unlock()
+
+	select {
+	case entry := <-waiter:
+		return entry, true
+	case <-done:
+	}
+
 	c.clientsLock.Lock()
 	defer c.clientsLock.Unlock()
+	waiters := c.waiters[id]
+	for i, w := range waiters {
+		if w == waiter {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(c.waiters, id)
+	} else {
+		c.waiters[id] = waiters
+	}
+	// The entry may have been added while we were giving up
+	select {
+	case entry := <-waiter:
+		return entry, true
+	default:
+		return nil, false
+	}
+}
+
+// remove removes entry from the map and closes its server->client connection,
+// which cancels any server->client RPCs that are still in flight. If id has since
+// been taken over by a different entry, remove does nothing, as the replaced entry
+// was already closed by whoever replaced it.
+func (c *clientMap[ClientService]) remove(id uuid.UUID, entry *clientEntry[ClientService]) error {
+	c.clientsLock.Lock()
+	if current, ok := c.clients[id]; !ok || current != entry {
+		c.clientsLock.Unlock()
+		return nil
+	}
 	delete(c.clients, id)
+	c.clientsLock.Unlock()
+	return entry.closeConn()
+}
+
+func (c *clientMap[ClientService]) get(id uuid.UUID) (*clientEntry[ClientService], bool) {
+	c.clientsLock.RLock()
+	defer c.clientsLock.RUnlock()
+	entry, ok := c.clients[id]
+	return entry, ok
 }
 
-func (c *clientMap[ClientService]) get(id uuid.UUID) (ClientService, bool) {
+func (c *clientMap[ClientService]) setTag(id uuid.UUID, key, value string) bool {
+	c.clientsLock.Lock()
+	defer c.clientsLock.Unlock()
+	entry, ok := c.clients[id]
+	if !ok {
+		return false
+	}
+	if entry.tags == nil {
+		entry.tags = make(map[string]string)
+	}
+	entry.tags[key] = value
+	return true
+}
+
+func (c *clientMap[ClientService]) tags(id uuid.UUID) (map[string]string, bool) {
 	c.clientsLock.RLock()
 	defer c.clientsLock.RUnlock()
-	client, ok := c.clients[id]
-	return client, ok
+	entry, ok := c.clients[id]
+	if !ok {
+		return nil, false
+	}
+	return copyTags(entry.tags), true
+}
+
+// ids returns the ids of up to limit clients, and the number of clients.
+func (c *clientMap[ClientService]) ids(limit int) ([]uuid.UUID, int) {
+	c.clientsLock.RLock()
+	defer c.clientsLock.RUnlock()
+	ids := make([]uuid.UUID, 0, min(limit, len(c.clients)))
+	for id := range c.clients {
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, id)
+	}
+	return ids, len(c.clients)
+}
+
+// clientSnapshot is a point-in-time copy of a client entry that can be used
+// without holding the clientMap lock.
+type clientSnapshot[ClientService any] struct {
+	id     uuid.UUID
+	client ClientService
+	tags   map[string]string
+}
+
+func (c *clientMap[ClientService]) snapshot() []clientSnapshot[ClientService] {
+	c.clientsLock.RLock()
+	defer c.clientsLock.RUnlock()
+	snapshots := make([]clientSnapshot[ClientService], 0, len(c.clients))
+	for id, entry := range c.clients {
+		if entry.callbackErr() != nil {
+			continue
+		}
+		snapshots = append(snapshots, clientSnapshot[ClientService]{
+			id:     id,
+			client: entry.client,
+			tags:   copyTags(entry.tags),
+		})
+	}
+	return snapshots
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	cp := make(map[string]string, len(tags))
+	for k, v := range tags {
+		cp[k] = v
+	}
+	return cp
 }
 
 func newClientMap[ClientService any]() *clientMap[ClientService] {
 	return &clientMap[ClientService]{
-		clients: make(map[uuid.UUID]ClientService),
+		clients: make(map[uuid.UUID]*clientEntry[ClientService]),
+		waiters: make(map[uuid.UUID][]chan *clientEntry[ClientService]),
 	}
 }
@@ -0,0 +1,222 @@
+package brpc_test
+
+import (
+	"context"
+	"github.com/clarkmcc/brpc"
+	"github.com/clarkmcc/brpc/brpctest"
+	"github.com/clarkmcc/brpc/internal/example"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"testing"
+	"time"
+)
+
+// fixedNamer answers every Name call with name.
+type fixedNamer struct {
+	example.UnimplementedNamerServer
+	name string
+}
+
+func (n fixedNamer) Name(context.Context, *example.NameRequest) (*example.NameResponse, error) {
+	return &example.NameResponse{Name: n.name}, nil
+}
+
+// serveNamer serves namer to server->client calls on conn until the test
+// finishes.
+func serveNamer(t *testing.T, conn *brpc.ClientConn, namer example.NamerServer) {
+	t.Helper()
+	shutdown, served := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(served)
+		_ = brpc.ServeClientService[any](shutdown, conn, func(registrar grpc.ServiceRegistrar) {
+			example.RegisterNamerServer(registrar, namer)
+		})
+	}()
+	t.Cleanup(func() {
+		close(shutdown)
+		<-served
+	})
+}
+
+// startFixedIDServer serves a server that assigns every client id with policy.
+func startFixedIDServer(t *testing.T, id uuid.UUID, policy brpc.DuplicatePolicy) (*brpc.Server[example.NamerClient], *brpctest.Listener) {
+	t.Helper()
+	server := brpc.NewServer(brpc.ServerConfig[example.NamerClient]{
+		ClientServiceBuilder: example.NewNamerClient,
+		ClientIDFunc:         func(context.Context, brpc.Conn) (uuid.UUID, error) { return id, nil },
+		OnDuplicateClientID:  policy,
+	})
+	return server, startServer(t, server)
+}
+
+// calledName calls the client registered for id and returns the name it answers
+// with.
+func calledName(t *testing.T, server *brpc.Server[example.NamerClient], id uuid.UUID) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	client, err := server.WaitForClient(ctx, id)
+	if err != nil {
+		t.Fatalf("waiting for the client: %v", err)
+	}
+	res, err := client.Name(ctx, &example.NameRequest{})
+	if err != nil {
+		t.Fatalf("calling the client: %v", err)
+	}
+	return res.GetName()
+}
+
+func TestDuplicateClientIDRejected(t *testing.T) {
+	id := uuid.New()
+	server, listener := startFixedIDServer(t, id, brpc.DuplicateReject)
+	first := dial(t, listener)
+	serveNamer(t, first, fixedNamer{name: "first"})
+	if name := calledName(t, server, id); name != "first" {
+		t.Fatalf("got %q, want the first client", name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	second, err := brpc.DialContext(ctx, "pipe", nil, brpc.WithTransport(listener.Transport()))
+	if err == nil {
+		_ = second.Close()
+		t.Fatal("dialing a duplicate client succeeded")
+	}
+	if reason, ok := brpc.ReasonFromError(err); !ok || reason != brpc.ReasonDuplicateClientID {
+		t.Errorf("got %v, want reason %v", err, brpc.ReasonDuplicateClientID)
+	}
+
+	select {
+	case <-first.Done():
+		t.Fatalf("first client was closed: %v", first.Err())
+	default:
+	}
+	if name := calledName(t, server, id); name != "first" {
+		t.Errorf("got %q, want the first client to keep the id", name)
+	}
+}
+
+func TestDuplicateClientIDReplaced(t *testing.T) {
+	id := uuid.New()
+	server, listener := startFixedIDServer(t, id, brpc.DuplicateReplace)
+	first := dial(t, listener)
+	serveNamer(t, first, fixedNamer{name: "first"})
+	if name := calledName(t, server, id); name != "first" {
+		t.Fatalf("got %q, want the first client", name)
+	}
+
+	second := dial(t, listener)
+	serveNamer(t, second, fixedNamer{name: "second"})
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	select {
+	case <-first.Done():
+	case <-ctx.Done():
+		t.Fatal("first client wasn't closed")
+	}
+	if reason, ok := brpc.ReasonFromError(first.Err()); !ok || reason != brpc.ReasonReplaced {
+		t.Errorf("got %v, want reason %v", first.Err(), brpc.ReasonReplaced)
+	}
+	if name := calledName(t, server, id); name != "second" {
+		t.Errorf("got %q, want the second client to take over the id", name)
+	}
+}
+
+// holdingNamer reports every Name call on started and holds it until release is
+// closed.
+type holdingNamer struct {
+	example.UnimplementedNamerServer
+	name    string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (n *holdingNamer) Name(ctx context.Context, _ *example.NameRequest) (*example.NameResponse, error) {
+	n.started <- struct{}{}
+	select {
+	case <-n.release:
+		return &example.NameResponse{Name: n.name}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestDuplicateClientIDHandoverDrainsOldConnection(t *testing.T) {
+	const handoverTimeout = time.Second
+	id := uuid.New()
+	server := brpc.NewServer(brpc.ServerConfig[example.NamerClient]{
+		ClientServiceBuilder: example.NewNamerClient,
+		ClientIDFunc:         func(context.Context, brpc.Conn) (uuid.UUID, error) { return id, nil },
+		OnDuplicateClientID:  brpc.DuplicateHandover,
+		HandoverTimeout:      handoverTimeout,
+	})
+	greeter := &holdingGreeter{started: make(chan struct{}, 1), release: make(chan struct{})}
+	example.RegisterGreeterServer(server.Server, greeter)
+	events := server.Events()
+	listener := startServer(t, server)
+
+	first := dial(t, listener)
+	namer := &holdingNamer{name: "first", started: make(chan struct{}, 1), release: make(chan struct{})}
+	serveNamer(t, first, namer)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	client, err := server.WaitForClient(ctx, id)
+	if err != nil {
+		t.Fatalf("waiting for the client: %v", err)
+	}
+
+	// Start a call in each direction on the first connection
+	callbackErr := make(chan error, 1)
+	go func() {
+		_, err := client.Name(ctx, &example.NameRequest{})
+		callbackErr <- err
+	}()
+	callErr := make(chan error, 1)
+	go func() {
+		_, err := example.NewGreeterClient(first).Greet(ctx, &example.GreetRequest{})
+		callErr <- err
+	}()
+	<-namer.started
+	<-greeter.started
+
+	second := dial(t, listener)
+	serveNamer(t, second, fixedNamer{name: "second"})
+	// Both connections were registered once the second one is
+	for connected := 0; connected < 2; {
+		select {
+		case event := <-events:
+			if event.Type == brpc.ClientEventConnected {
+				connected++
+			}
+		case <-ctx.Done():
+			t.Fatal("second client wasn't registered")
+		}
+	}
+	if name := calledName(t, server, id); name != "second" {
+		t.Fatalf("got %q, want the second client to take over the id", name)
+	}
+	select {
+	case <-first.Done():
+		t.Fatalf("first client was closed with calls in flight: %v", first.Err())
+	default:
+	}
+
+	// The calls in flight finish on the first connection, which is only closed
+	// once the handover timeout expired.
+	close(namer.release)
+	close(greeter.release)
+	if err := <-callbackErr; err != nil {
+		t.Errorf("server->client call in flight failed: %v", err)
+	}
+	if err := <-callErr; err != nil {
+		t.Errorf("client->server call in flight failed: %v", err)
+	}
+	select {
+	case <-first.Done():
+	case <-ctx.Done():
+		t.Fatal("first client wasn't closed after the handover timeout")
+	}
+	if reason, ok := brpc.ReasonFromError(first.Err()); !ok || reason != brpc.ReasonReplaced {
+		t.Errorf("got %v, want reason %v", first.Err(), brpc.ReasonReplaced)
+	}
+}
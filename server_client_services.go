@@ -0,0 +1,86 @@
+package brpc
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"reflect"
+	"sync"
+)
+
+// clientServiceKey identifies the client services registered with
+// RegisterClientService by the type of their stub.
+type clientServiceKey[T any] struct{}
+
+// clientServices holds the builders registered with RegisterClientService.
+type clientServices struct {
+	builders map[any]func(cc grpc.ClientConnInterface) any
+	lock     sync.RWMutex
+}
+
+func newClientServices() *clientServices {
+	return &clientServices{builders: make(map[any]func(cc grpc.ClientConnInterface) any)}
+}
+
+func (s *clientServices) register(key any, builder func(cc grpc.ClientConnInterface) any) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.builders[key] = builder
+}
+
+// empty reports whether no client services are registered.
+func (s *clientServices) empty() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.builders) == 0
+}
+
+// build builds a stub of every registered client service on conn.
+func (s *clientServices) build(conn grpc.ClientConnInterface) map[any]any {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	stubs := make(map[any]any, len(s.builders))
+	for key, builder := range s.builders {
+		stubs[key] = builder(conn)
+	}
+	return stubs
+}
+
+// RegisterClientService registers builder, typically a constructor generated by
+// protoc, for another service that clients serve next to the one built by
+// ServerConfig.ClientServiceBuilder. A stub is built for every client that
+// connects afterwards, which ClientServiceFromContext returns by its type T.
+// Registering a builder for the same T again replaces it. Registering any client
+// service enables server->client calls, even without a ClientServiceBuilder.
+//
+//	brpc.RegisterClientService(server, example.NewNamerClient)
+//	brpc.RegisterClientService(server, example.NewMetricsClient)
+func RegisterClientService[T, C any](s *Server[C], builder func(cc grpc.ClientConnInterface) T) {
+	s.clientServices.register(clientServiceKey[T]{}, func(cc grpc.ClientConnInterface) any {
+		return builder(cc)
+	})
+}
+
+// ClientServiceFromContext is like Server.ClientFromContext, but returns the stub
+// of type T that was built for the calling client by the builder registered with
+// RegisterClientService. If no builder for T was registered before the client
+// connected, it fails with a codes.FailedPrecondition status error wrapping
+// ErrClientServiceNotRegistered.
+//
+//	metrics, err := brpc.ClientServiceFromContext[example.MetricsClient](ctx, server)
+func ClientServiceFromContext[T, C any](ctx context.Context, s *Server[C]) (client T, err error) {
+	entry, err := s.entryFromContext(ctx)
+	if err != nil {
+		return client, err
+	}
+	if err := entry.callbackErr(); err != nil {
+		return client, err
+	}
+	client, ok := entry.services[clientServiceKey[T]{}].(T)
+	if !ok {
+		err := fmt.Errorf("%w: %v", ErrClientServiceNotRegistered, reflect.TypeOf(&client).Elem())
+		return client, newStatusError(codes.FailedPrecondition, err)
+	}
+	return client, nil
+}
@@ -0,0 +1,101 @@
+package brpc
+
+import (
+	"github.com/google/uuid"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// eventBufferSize is the number of events buffered for each subscriber of
+// Server.Events before further events are dropped.
+const eventBufferSize = 64
+
+// ClientEventType is the kind of a ClientEvent.
+type ClientEventType int
+
+const (
+	// ClientEventConnected is sent once a client is registered and can be called.
+	ClientEventConnected ClientEventType = iota + 1
+	// ClientEventDisconnected is sent once a client's connection was closed.
+	ClientEventDisconnected
+)
+
+func (t ClientEventType) String() string {
+	switch t {
+	case ClientEventConnected:
+		return "connected"
+	case ClientEventDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// ClientEvent describes a change in the lifecycle of a client.
+type ClientEvent struct {
+	Type ClientEventType
+	ID   uuid.UUID
+	Addr net.Addr
+}
+
+// Events returns a channel that receives every client lifecycle event from now
+// on. Each call returns a new subscription, so multiple consumers each see all
+// events. Events are buffered, if a subscriber falls too far behind, events are
+// dropped for it rather than blocking the server, see DroppedEvents. The channel
+// is closed once the server has stopped and all connections are closed.
+func (s *Server[C]) Events() <-chan ClientEvent {
+	return s.events.subscribe()
+}
+
+// DroppedEvents returns how many events were dropped across all subscribers of
+// Events because they weren't consumed quickly enough.
+func (s *Server[C]) DroppedEvents() uint64 {
+	return s.events.dropped.Load()
+}
+
+// eventBroker fans out client events to all subscribers.
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers []chan ClientEvent
+	closed      bool
+	dropped     atomic.Uint64
+}
+
+func (b *eventBroker) subscribe() <-chan ClientEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan ClientEvent, eventBufferSize)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subscribers = append(b.subscribers, ch)
+	return ch
+}
+
+func (b *eventBroker) publish(event ClientEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// close closes all subscriptions, events published afterwards are discarded.
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for _, ch := range b.subscribers {
+		close(ch)
+	}
+	b.subscribers = nil
+}
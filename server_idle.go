@@ -0,0 +1,106 @@
+package brpc
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"sync/atomic"
+	"time"
+)
+
+// idleTimer tracks the RPC activity on a single client connection so that the
+// connection can be closed once it has been idle for longer than timeout. A nil
+// *idleTimer is valid and never expires, which is used when the timeout is disabled.
+type idleTimer struct {
+	timeout    time.Duration
+	lastActive atomic.Int64 // Unix nanoseconds of the last observed activity
+	inFlight   atomic.Int64 // Number of RPCs currently running
+}
+
+func newIdleTimer(timeout time.Duration) *idleTimer {
+	if timeout <= 0 {
+		return nil
+	}
+	t := &idleTimer{timeout: timeout}
+	t.touch()
+	return t
+}
+
+// touch records activity, resetting the idle window.
+func (t *idleTimer) touch() {
+	if t == nil {
+		return
+	}
+	t.lastActive.Store(time.Now().UnixNano())
+}
+
+// begin records the start of an RPC. The connection isn't considered idle while
+// an RPC is in flight. The returned function must be called when the RPC ends.
+func (t *idleTimer) begin() func() {
+	if t == nil {
+		return func() {}
+	}
+	t.touch()
+	t.inFlight.Add(1)
+	return func() {
+		t.touch()
+		t.inFlight.Add(-1)
+	}
+}
+
+// expired returns a channel that is closed once the connection has been idle for
+// longer than the timeout. The channel is never closed if ctx is done first.
+func (t *idleTimer) expired(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{})
+	if t == nil {
+		return ch
+	}
+	go func() {
+		timer := time.NewTimer(t.timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			idle := time.Since(time.Unix(0, t.lastActive.Load()))
+			if t.inFlight.Load() == 0 && idle >= t.timeout {
+				close(ch)
+				return
+			}
+			timer.Reset(max(t.timeout-idle, time.Millisecond))
+		}
+	}()
+	return ch
+}
+
+func (t *idleTimer) unaryClientInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	defer t.begin()()
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func (t *idleTimer) streamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	t.touch()
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil || t == nil {
+		return stream, err
+	}
+	return &idleClientStream{ClientStream: stream, idle: t}, nil
+}
+
+// idleClientStream records activity for every message sent or received on a
+// server->client stream.
+type idleClientStream struct {
+	grpc.ClientStream
+	idle *idleTimer
+}
+
+func (s *idleClientStream) SendMsg(m any) error {
+	s.idle.touch()
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *idleClientStream) RecvMsg(m any) error {
+	defer s.idle.touch()
+	return s.ClientStream.RecvMsg(m)
+}
@@ -0,0 +1,186 @@
+package brpc
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// ServerOptions returns the grpc.ServerOptions that install the brpc interceptors
+// on a gRPC server. Features that observe client->server RPCs (such as
+// ServerConfig.IdleTimeout) only work if these options are used. NewServer uses
+// them when it builds the gRPC server itself. To bring your own gRPC server,
+// construct it afterwards, since the interceptors need the brpc server:
+//
+//	server := brpc.NewServer(brpc.ServerConfig[example.NamerClient]{...})
+//	server.Server = grpc.NewServer(append(server.ServerOptions(), myOptions...)...)
+func (s *Server[C]) ServerOptions() []grpc.ServerOption {
+	options := append(tracingServerOptions(s.tracePropagation), messageSizeServerOptions(s.maxMessageSize)...)
+	return append(options,
+		grpc.ChainUnaryInterceptor(s.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(s.StreamServerInterceptor()),
+	)
+}
+
+// UnaryServerInterceptor returns the brpc interceptor for unary client->server RPCs.
+func (s *Server[C]) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		entry, err := s.interceptEntry(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			release, err := s.acquireStream(entry)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			defer entry.idle.begin()()
+			if s.injectClient {
+				ctx = context.WithValue(ctx, clientEntryKey[C]{}, entry)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns the brpc interceptor for streaming client->server RPCs.
+func (s *Server[C]) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		entry, err := s.interceptEntry(ss.Context())
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			release, err := s.acquireStream(entry)
+			if err != nil {
+				return err
+			}
+			defer release()
+			defer entry.idle.begin()()
+			if s.injectClient {
+				ss = &serverStream{
+					ServerStream: ss,
+					ctx:          context.WithValue(ss.Context(), clientEntryKey[C]{}, entry),
+				}
+			}
+		}
+		return handler(srv, ss)
+	}
+}
+
+// acquireStream counts an in-flight RPC against the client's stream limit. The
+// returned func must be called once the RPC has finished.
+func (s *Server[C]) acquireStream(entry *clientEntry[C]) (release func(), err error) {
+	if s.maxStreamsPerClient <= 0 {
+		return func() {}, nil
+	}
+	if entry.streams.Add(1) > int64(s.maxStreamsPerClient) {
+		entry.streams.Add(-1)
+		return nil, newStatusError(codes.ResourceExhausted, ErrTooManyStreams)
+	}
+	return func() {
+		entry.streams.Add(-1)
+	}, nil
+}
+
+// interceptEntry returns the calling client's entry, which is nil if the client
+// can't be resolved. An error is only returned when the client must be injected,
+// or when the client claims an id that belongs to another connection.
+func (s *Server[C]) interceptEntry(ctx context.Context) (*clientEntry[C], error) {
+	if s.injectClient {
+		return s.entryFromContext(ctx)
+	}
+	id, err := s.callerID(ctx)
+	if errors.Is(err, ErrClientIDMismatch) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, nil
+	}
+	entry, _ := s.clients.get(id)
+	return entry, nil
+}
+
+// clientEntryKey is the context key that the calling client's entry is injected
+// under when ServerConfig.InjectClient is enabled.
+type clientEntryKey[C any] struct{}
+
+// ClientFromContextTyped returns the client service stub that the brpc
+// interceptors injected into ctx, see ServerConfig.InjectClient. Unlike
+// Server.ClientFromContext it doesn't need the server, so it can be used from
+// code that only sees the context.
+func ClientFromContextTyped[C any](ctx context.Context) (client C, err error) {
+	entry, ok := ctx.Value(clientEntryKey[C]{}).(*clientEntry[C])
+	if !ok {
+		return client, newStatusError(codes.Internal, ErrClientNotInjected)
+	}
+	if err := entry.callbackErr(); err != nil {
+		return client, err
+	}
+	return entry.client, nil
+}
+
+// callbackIdentifier adds the id of the client that a server->client RPC is
+// routed to into the RPC's metadata, under the same key that client->server
+// RPCs use, so client handlers can tell which connection a call arrived on,
+// see CallbackClientID.
+type callbackIdentifier struct {
+	id  uuid.UUID
+	key string
+}
+
+func (c callbackIdentifier) unaryClientInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(c.context(ctx), method, req, reply, cc, opts...)
+}
+
+func (c callbackIdentifier) streamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(c.context(ctx), desc, cc, method, opts...)
+}
+
+// context adds the client id to the outgoing metadata of ctx, and stores it for
+// CallbackTargetID.
+func (c callbackIdentifier) context(ctx context.Context) context.Context {
+	return withClientID(context.WithValue(ctx, callbackTargetKey{}, c.id), c.key, c.id)
+}
+
+// callbackTargetKey is the context key that callbackIdentifier stores the id of
+// the client that a server->client RPC is routed to under.
+type callbackTargetKey struct{}
+
+// CallbackTargetID returns the id of the client that a server->client RPC is
+// routed to, for use in ServerConfig.CallbackUnaryInterceptor and
+// CallbackStreamInterceptor. It returns false for contexts of other RPCs.
+func CallbackTargetID(ctx context.Context) (uuid.UUID, bool) {
+	id, ok := ctx.Value(callbackTargetKey{}).(uuid.UUID)
+	return id, ok
+}
+
+// clientIDKeyContextKey is the context key that the client's callback server
+// stores the client id metadata key under, so that CallbackClientID can read
+// the id without access to the ClientConn.
+type clientIDKeyContextKey struct{}
+
+// callbackKey stores the client id metadata key in the context of the
+// server->client RPCs that a client serves.
+type callbackKey string
+
+func (k callbackKey) unaryServerInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	return handler(context.WithValue(ctx, clientIDKeyContextKey{}, string(k)), req)
+}
+
+func (k callbackKey) streamServerInterceptor(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &serverStream{ServerStream: ss, ctx: context.WithValue(ss.Context(), clientIDKeyContextKey{}, string(k))})
+}
+
+// serverStream overrides the context of a grpc.ServerStream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,78 @@
+package brpc_test
+
+import (
+	"context"
+	"github.com/clarkmcc/brpc"
+	"github.com/clarkmcc/brpc/brpctest"
+	"github.com/clarkmcc/brpc/internal/example"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// holdingGreeter reports every Greet on started and holds it until release is
+// closed.
+type holdingGreeter struct {
+	example.UnimplementedGreeterServer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *holdingGreeter) Greet(ctx context.Context, _ *example.GreetRequest) (*example.GreetResponse, error) {
+	g.started <- struct{}{}
+	select {
+	case <-g.release:
+		return &example.GreetResponse{Greeting: "Hello"}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestMaxConcurrentStreamsPerClient(t *testing.T) {
+	const limit = 2
+	greeter := &holdingGreeter{started: make(chan struct{}, limit+1), release: make(chan struct{})}
+	h := brpctest.NewHarness(t, brpctest.HarnessConfig[example.NamerClient]{
+		Server: brpc.ServerConfig[example.NamerClient]{
+			ClientServiceBuilder:          example.NewNamerClient,
+			MaxConcurrentStreamsPerClient: limit,
+		},
+		RegisterServer: func(_ *brpc.Server[example.NamerClient], registrar grpc.ServiceRegistrar) {
+			example.RegisterGreeterServer(registrar, greeter)
+		},
+	})
+	client := example.NewGreeterClient(h.Client)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	errs := make(chan error, limit)
+	for i := 0; i < limit; i++ {
+		go func() {
+			_, err := client.Greet(ctx, &example.GreetRequest{})
+			errs <- err
+		}()
+	}
+	for i := 0; i < limit; i++ {
+		select {
+		case <-greeter.started:
+		case <-ctx.Done():
+			t.Fatal("calls within the limit didn't start")
+		}
+	}
+
+	_, err := client.Greet(ctx, &example.GreetRequest{})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v for the call over the limit, want %v", err, codes.ResourceExhausted)
+	}
+
+	// Once the calls in flight finished, their slots are free again
+	close(greeter.release)
+	for i := 0; i < limit; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("call within the limit failed: %v", err)
+		}
+	}
+	if _, err := client.Greet(ctx, &example.GreetRequest{}); err != nil {
+		t.Fatalf("call after the slots were released failed: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package brpc
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// locatorTimeout bounds how long registering a client with, or unregistering it
+// from, the ClientLocator may take.
+const locatorTimeout = 5 * time.Second
+
+// ClientLocator keeps track of which server instance each client is connected
+// to, so that in a deployment with several brpc servers, a handler running on
+// one instance can find the instance that hosts a client and forward its
+// server->client call there, see Server.LocateClient. Instances are identified
+// by ServerConfig.InstanceAddress. Implementations backed by an external
+// registry, such as Redis or etcd, share the locations across all instances,
+// and must be safe for concurrent use.
+type ClientLocator interface {
+	// Register records that the client with id is connected to instance,
+	// replacing any previous record for id.
+	Register(ctx context.Context, id uuid.UUID, instance string) error
+
+	// Unregister removes the record for id, but only if it still points to
+	// instance, since the client may have reconnected to another instance
+	// before this one noticed that it disconnected.
+	Unregister(ctx context.Context, id uuid.UUID, instance string) error
+
+	// Locate returns the instance that the client with id is connected to. It
+	// returns an error wrapping ErrClientNotConnected if there is none.
+	Locate(ctx context.Context, id uuid.UUID) (instance string, err error)
+}
+
+// MemoryClientLocator is a ClientLocator that keeps the locations in memory. It
+// only knows about the clients of the servers in the same process, which makes
+// it suitable for single-node deployments and tests. It is the default
+// ClientLocator.
+type MemoryClientLocator struct {
+	mu        sync.RWMutex
+	instances map[uuid.UUID]string
+}
+
+// NewMemoryClientLocator returns an empty MemoryClientLocator.
+func NewMemoryClientLocator() *MemoryClientLocator {
+	return &MemoryClientLocator{instances: make(map[uuid.UUID]string)}
+}
+
+func (l *MemoryClientLocator) Register(_ context.Context, id uuid.UUID, instance string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.instances[id] = instance
+	return nil
+}
+
+func (l *MemoryClientLocator) Unregister(_ context.Context, id uuid.UUID, instance string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.instances[id] == instance {
+		delete(l.instances, id)
+	}
+	return nil
+}
+
+func (l *MemoryClientLocator) Locate(_ context.Context, id uuid.UUID) (string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	instance, ok := l.instances[id]
+	if !ok {
+		return "", ErrClientNotConnected
+	}
+	return instance, nil
+}
+
+// LocateClient returns the server instance that the client with id is connected
+// to, as registered with the ClientLocator, and whether that is this server. If
+// it is, the client can be called directly with Server.Client, otherwise the
+// call has to be forwarded to the returned instance, for example over an
+// application-defined gRPC service between the instances. Returns an error
+// wrapping ErrClientNotConnected if the client isn't connected to any instance.
+func (s *Server[C]) LocateClient(ctx context.Context, id uuid.UUID) (instance string, local bool, err error) {
+	if _, ok := s.clients.get(id); ok {
+		return s.instanceAddress(), true, nil
+	}
+	instance, err = s.locator.Locate(ctx, id)
+	if err != nil {
+		return "", false, err
+	}
+	return instance, instance == s.instanceAddress(), nil
+}
+
+// instanceAddress returns the address that identifies this server to the
+// ClientLocator, which defaults to the address it listens on.
+func (s *Server[C]) instanceAddress() string {
+	if s.instance != "" {
+		return s.instance
+	}
+	return s.listener.Addr().String()
+}
+
+// registerLocation registers the client with id with the ClientLocator, and
+// returns a function that unregisters it again, unless the client was replaced
+// by a client with the same id on this server in the meantime.
+func (s *Server[C]) registerLocation(id uuid.UUID, entry *clientEntry[C]) (unregister func()) {
+	instance := s.instanceAddress()
+	ctx, cancel := context.WithTimeout(context.Background(), locatorTimeout)
+	defer cancel()
+	if err := s.locator.Register(ctx, id, instance); err != nil {
+		s.logger().Warn("registering client location", "id", id, "instance", instance, "error", err)
+	}
+	return func() {
+		if current, ok := s.clients.get(id); ok && current != entry {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), locatorTimeout)
+		defer cancel()
+		if err := s.locator.Unregister(ctx, id, instance); err != nil {
+			s.logger().Warn("unregistering client location", "id", id, "instance", instance, "error", err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package brpc
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ipRateLimiter limits how often each remote IP may connect, using a token bucket
+// per IP. Buckets that have refilled completely are indistinguishable from new
+// ones, so they are swept periodically to bound memory to the IPs that connected
+// recently.
+type ipRateLimiter struct {
+	rate  float64 // Tokens added per second
+	burst float64 // Bucket capacity
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // When tokens was last updated
+}
+
+// newIPRateLimiter returns a limiter that allows rate connections per second
+// from each IP, with bursts of up to burst connections, or nil if rate isn't
+// positive. A burst below one allows one connection.
+func newIPRateLimiter(rate float64, burst int) *ipRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &ipRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// allow reports whether a connection from addr may proceed, taking a token from
+// its IP's bucket if so. A nil limiter allows everything.
+func (l *ipRateLimiter) allow(addr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+	ip := addrIP(addr)
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = bucket
+	}
+	bucket.refill(now, l.rate, l.burst)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// sweep removes the buckets that have refilled completely, at most once per
+// refill period.
+func (l *ipRateLimiter) sweep(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) < refill {
+		return
+	}
+	l.lastSweep = now
+	for ip, bucket := range l.buckets {
+		bucket.refill(now, l.rate, l.burst)
+		if bucket.tokens >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// addrIP returns the IP of addr, or its string form if it doesn't have one.
+func addrIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP.String()
+	case *net.TCPAddr:
+		return addr.IP.String()
+	}
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,33 @@
+package brpc_test
+
+import (
+	"context"
+	"github.com/clarkmcc/brpc"
+	"github.com/clarkmcc/brpc/internal/example"
+	"testing"
+)
+
+func TestConnectionRateLimitRejectsBurst(t *testing.T) {
+	const burst = 2
+	server := brpc.NewServer(brpc.ServerConfig[example.NamerClient]{
+		// A rate this low doesn't refill the bucket while the test runs
+		ConnectionRatePerIP:  0.001,
+		ConnectionBurstPerIP: burst,
+	})
+	listener := startServer(t, server)
+
+	// In-memory connections all come from the same address
+	for i := 0; i < burst; i++ {
+		dial(t, listener)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	conn, err := brpc.DialContext(ctx, "pipe", nil, brpc.WithTransport(listener.Transport()))
+	if err == nil {
+		_ = conn.Close()
+		t.Fatal("dialing over the burst succeeded")
+	}
+	if reason, ok := brpc.ReasonFromError(err); !ok || reason != brpc.ReasonRateLimited {
+		t.Fatalf("got %v, want reason %v", err, brpc.ReasonRateLimited)
+	}
+}
@@ -0,0 +1,148 @@
+package brpc
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats receives connection-level events from a Server, for exporting metrics
+// that gRPC's stats.Handler can't see because they happen below the gRPC
+// connections. Methods are called synchronously, so they should return quickly,
+// and concurrently for different connections. Embed NopStats to only implement
+// some of the events.
+type Stats interface {
+	// ConnBegin is called when a connection is accepted, before the handshake.
+	ConnBegin(addr net.Addr)
+	// ConnRejected is called when a connection is closed right after it was
+	// accepted, without ConnBegin, because the server is at
+	// ServerConfig.MaxConnections (err is ErrTooManyConnections) or the remote
+	// IP exceeded ServerConfig.ConnectionRatePerIP (err is ErrRateLimited).
+	ConnRejected(addr net.Addr, err error)
+	// HandshakeFailed is called when a connection is closed because the
+	// handshake failed, or because the client couldn't be registered.
+	HandshakeFailed(addr net.Addr, err error)
+	// ClientConnected is called once the client on a connection is registered
+	// and can be called by the server.
+	ClientConnected(id uuid.UUID, addr net.Addr)
+	// ClientCall is called when a server->client RPC finishes. Streaming RPCs
+	// finish once the client ends the stream or it fails.
+	ClientCall(id uuid.UUID, method string, duration time.Duration, err error)
+	// ConnEnd is called once a connection is closed, after ConnBegin.
+	ConnEnd(info ConnEndInfo)
+}
+
+// ConnEndInfo describes a connection that was closed.
+type ConnEndInfo struct {
+	RemoteAddr net.Addr
+	// ClientID is the id the client was registered under, which is uuid.Nil if
+	// the connection didn't make it past ClientConnected.
+	ClientID uuid.UUID
+	// BytesRead and BytesWritten count the bytes transferred over the
+	// connection's gRPC streams in both directions.
+	BytesRead    int64
+	BytesWritten int64
+	// Err is the error that the connection handler failed with, if any.
+	Err error
+}
+
+var _ Stats = NopStats{}
+
+// NopStats is a Stats implementation that ignores all events.
+type NopStats struct{}
+
+func (NopStats) ConnBegin(net.Addr)                                 {}
+func (NopStats) ConnRejected(net.Addr, error)                       {}
+func (NopStats) HandshakeFailed(net.Addr, error)                    {}
+func (NopStats) ClientConnected(uuid.UUID, net.Addr)                {}
+func (NopStats) ClientCall(uuid.UUID, string, time.Duration, error) {}
+func (NopStats) ConnEnd(ConnEndInfo)                                {}
+
+// byteCounter counts the bytes transferred over a connection's streams.
+type byteCounter struct {
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+// wrap returns conn with its reads and writes counted.
+func (b *byteCounter) wrap(conn net.Conn) net.Conn {
+	return &countingConn{Conn: conn, counter: b}
+}
+
+type countingConn struct {
+	net.Conn
+	counter *byteCounter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.counter.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.counter.written.Add(int64(n))
+	return n, err
+}
+
+// callStats reports server->client RPCs of a single client to a Stats.
+type callStats struct {
+	stats Stats
+	id    uuid.UUID
+}
+
+func (c *callStats) unaryClientInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	c.stats.ClientCall(c.id, method, time.Since(start), err)
+	return err
+}
+
+func (c *callStats) streamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	start := time.Now()
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		c.stats.ClientCall(c.id, method, time.Since(start), err)
+		return nil, err
+	}
+	return &statsClientStream{
+		ClientStream:  stream,
+		calls:         c,
+		method:        method,
+		start:         start,
+		serverStreams: desc.ServerStreams,
+	}, nil
+}
+
+// statsClientStream reports the stream to Stats once receiving from it fails,
+// which is how gRPC signals that a stream has finished, or once the response of
+// a client-streaming RPC was received.
+type statsClientStream struct {
+	grpc.ClientStream
+	calls         *callStats
+	method        string
+	start         time.Time
+	serverStreams bool
+	once          sync.Once
+}
+
+func (s *statsClientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil || !s.serverStreams {
+		s.once.Do(func() {
+			callErr := err
+			if errors.Is(err, io.EOF) {
+				callErr = nil
+			}
+			s.calls.stats.ClientCall(s.calls.id, s.method, time.Since(s.start), callErr)
+		})
+	}
+	return err
+}
@@ -0,0 +1,238 @@
+package brpc_test
+
+import (
+	"context"
+	"errors"
+	"github.com/clarkmcc/brpc"
+	"github.com/clarkmcc/brpc/brpctest"
+	"github.com/clarkmcc/brpc/internal/example"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// endStats reports the connections that the server finished handling.
+type endStats struct {
+	brpc.NopStats
+	ends chan brpc.ConnEndInfo
+}
+
+func (s endStats) ConnEnd(info brpc.ConnEndInfo) {
+	s.ends <- info
+}
+
+// panickingLocator fails the handler right after the client was registered.
+type panickingLocator struct {
+	brpc.ClientLocator
+}
+
+func (panickingLocator) Register(context.Context, uuid.UUID, string) error {
+	panic("registering location")
+}
+
+func TestClientRemovedWhenConnectionFails(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config brpc.ServerConfig[example.NamerClient]
+	}{
+		{
+			// An invalid service config makes dialing the client's gRPC server fail.
+			name: "callback dial fails",
+			config: brpc.ServerConfig[example.NamerClient]{
+				CallbackDialOptions: []grpc.DialOption{grpc.WithDefaultServiceConfig("invalid")},
+			},
+		},
+		{
+			name: "tolerated callback dial failure",
+			config: brpc.ServerConfig[example.NamerClient]{
+				CallbackDialOptions:     []grpc.DialOption{grpc.WithDefaultServiceConfig("invalid")},
+				TolerateCallbackFailure: true,
+			},
+		},
+		{
+			name: "handler panics after registration",
+			config: brpc.ServerConfig[example.NamerClient]{
+				ClientLocator: panickingLocator{ClientLocator: brpc.NewMemoryClientLocator()},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			id := uuid.New()
+			stats := endStats{ends: make(chan brpc.ConnEndInfo, 1)}
+			config := tc.config
+			config.ClientServiceBuilder = example.NewNamerClient
+			config.ClientIDFunc = func(context.Context, brpc.Conn) (uuid.UUID, error) { return id, nil }
+			config.Stats = stats
+			server := brpc.NewServer(config)
+			listener := startServer(t, server)
+
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			conn, err := brpc.DialContext(ctx, "pipe", nil, brpc.WithTransport(listener.Transport()))
+			if err == nil {
+				// The handler keeps running while the client is connected.
+				time.Sleep(50 * time.Millisecond)
+				_ = conn.Close()
+			}
+			select {
+			case <-stats.ends:
+			case <-ctx.Done():
+				t.Fatal("the server didn't finish handling the connection")
+			}
+			if _, ok := server.Client(id); ok {
+				t.Error("the client is still registered after its connection ended")
+			}
+		})
+	}
+}
+
+func TestServeCancelledDuringHandshake(t *testing.T) {
+	server := brpc.NewServer(brpc.ServerConfig[example.NamerClient]{ClientServiceBuilder: example.NewNamerClient})
+	listener := brpctest.NewListener()
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeListener(ctx, listener)
+	}()
+	// The connection never sends its handshake, so the server is still waiting
+	// for it when ctx is cancelled.
+	conn, err := listener.Dial(context.Background())
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-served:
+	case <-time.After(testTimeout):
+		t.Fatal("serving didn't return after ctx was cancelled")
+	}
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(testTimeout):
+		t.Fatal("the server didn't close the connection that was handshaking")
+	}
+	waitForGoroutines(t, baseline)
+}
+
+// blockingGreeter holds every Greet until release is closed.
+type blockingGreeter struct {
+	example.UnimplementedGreeterServer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *blockingGreeter) Greet(context.Context, *example.GreetRequest) (*example.GreetResponse, error) {
+	close(g.started)
+	<-g.release
+	return &example.GreetResponse{Greeting: "Hello"}, nil
+}
+
+func TestServeStopsGracefullyWhenCancelled(t *testing.T) {
+	server := brpc.NewServer(brpc.ServerConfig[example.NamerClient]{ClientServiceBuilder: example.NewNamerClient})
+	greeter := &blockingGreeter{started: make(chan struct{}), release: make(chan struct{})}
+	example.RegisterGreeterServer(server.Server, greeter)
+	listener := brpctest.NewListener()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeListener(ctx, listener)
+	}()
+	conn := dial(t, listener, brpc.WithoutCallback())
+
+	called := make(chan error, 1)
+	go func() {
+		_, err := example.NewGreeterClient(conn).Greet(context.Background(), &example.GreetRequest{})
+		called <- err
+	}()
+	select {
+	case <-greeter.started:
+	case <-time.After(testTimeout):
+		t.Fatal("the call didn't reach the server")
+	}
+	cancel()
+
+	// The in-flight call drains before Serve returns.
+	select {
+	case err := <-served:
+		t.Fatalf("serving returned with a call in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(greeter.release)
+	select {
+	case err := <-called:
+		if err != nil {
+			t.Errorf("the in-flight call failed: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the in-flight call didn't finish")
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("serving returned %v, want context.Canceled", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("serving didn't return after ctx was cancelled")
+	}
+}
+
+func TestSpoofedClientIDIsRejected(t *testing.T) {
+	h := brpctest.NewHarness(t, brpctest.HarnessConfig[example.NamerClient]{
+		Server: brpc.ServerConfig[example.NamerClient]{ClientServiceBuilder: example.NewNamerClient},
+		RegisterServer: func(server *brpc.Server[example.NamerClient], registrar grpc.ServiceRegistrar) {
+			example.RegisterGreeterServer(registrar, &callbackGreeter{server: server})
+		},
+		// Without a callback the client doesn't set its own id, so the id below
+		// is the only one in the metadata.
+		DialOptions: []brpc.DialOption{brpc.WithoutCallback()},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, brpc.DefaultClientIDMetadataKey, uuid.New().String())
+	_, err := example.NewGreeterClient(h.Client).Greet(ctx, &example.GreetRequest{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, want %v", err, codes.PermissionDenied)
+	}
+	if !strings.Contains(status.Convert(err).Message(), brpc.ErrClientIDMismatch.Error()) {
+		t.Errorf("got %v, want %v", err, brpc.ErrClientIDMismatch)
+	}
+}
+
+func TestDisconnectClient(t *testing.T) {
+	server := brpc.NewServer(brpc.ServerConfig[example.NamerClient]{ClientServiceBuilder: example.NewNamerClient})
+	conn := dial(t, startServer(t, server))
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if _, err := server.WaitForClient(ctx, conn.ID()); err != nil {
+		t.Fatalf("waiting for the client: %v", err)
+	}
+
+	if err := server.DisconnectClient(conn.ID(), "kicked"); err != nil {
+		t.Fatalf("disconnecting: %v", err)
+	}
+	select {
+	case <-conn.Done():
+	case <-ctx.Done():
+		t.Fatal("client didn't notice that it was disconnected")
+	}
+	if reason, ok := brpc.ReasonFromError(conn.Err()); !ok || reason != brpc.ReasonDisconnected {
+		t.Errorf("got %v, want reason %v", conn.Err(), brpc.ReasonDisconnected)
+	}
+	if _, ok := server.Client(conn.ID()); ok {
+		t.Error("disconnected client is still registered")
+	}
+	if err := server.DisconnectClient(conn.ID(), ""); !errors.Is(err, brpc.ErrClientNotConnected) {
+		t.Errorf("got %v disconnecting twice, want %v", err, brpc.ErrClientNotConnected)
+	}
+}
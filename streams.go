@@ -0,0 +1,57 @@
+package brpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Every bidirectional stream starts with one of these bytes, written by the side
+// that opened it, so that the accepting side can route it: the client->server
+// gRPC stream to the server's gRPC server, the server->client gRPC stream to the
+// client's callback server, and raw streams to ServerConfig.RawStreamHandler.
+const (
+	streamTypeGRPCClientToServer byte = iota + 1
+	streamTypeGRPCServerToClient
+	streamTypeRaw
+)
+
+// streamTypeTimeout bounds how long the accepting side waits for the type of a
+// stream that the peer opened before closing it, so that streams without data
+// don't pile up.
+const streamTypeTimeout = 10 * time.Second
+
+// openTypedStream opens a bidirectional stream on conn and writes streamType to
+// it, see the streamType constants.
+func openTypedStream(ctx context.Context, conn Conn, streamType byte) (net.Conn, error) {
+	stream, err := conn.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := interruptOnDone(ctx, stream.SetWriteDeadline)
+	_, err = stream.Write([]byte{streamType})
+	stop()
+	if err == nil {
+		// The deadline of ctx only bounds opening the stream, not its use.
+		err = stream.SetWriteDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = stream.Close()
+		return nil, fmt.Errorf("writing stream type: %w", err)
+	}
+	return stream, nil
+}
+
+// readStreamType reads the type of a stream that the peer opened with
+// openTypedStream, giving up after streamTypeTimeout.
+func readStreamType(stream net.Conn) (byte, error) {
+	var streamType [1]byte
+	if err := stream.SetReadDeadline(time.Now().Add(streamTypeTimeout)); err != nil {
+		return 0, err
+	}
+	if _, err := stream.Read(streamType[:]); err != nil {
+		return 0, err
+	}
+	return streamType[0], stream.SetReadDeadline(time.Time{})
+}
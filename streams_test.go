@@ -0,0 +1,76 @@
+package brpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestPipe returns both ends of an in-memory yamux connection.
+func newTestPipe(t *testing.T) (client, server Conn) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	server, err := NewYamuxConn(serverConn, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = NewYamuxConn(clientConn, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.CloseWithReason(ReasonNormal, "")
+		_ = server.CloseWithReason(ReasonNormal, "")
+	})
+	return client, server
+}
+
+func TestConnListenerSkipsSilentStreams(t *testing.T) {
+	client, server := newTestPipe(t)
+	listener := newConnListener(server, streamTypeGRPCClientToServer)
+	defer listener.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), streamTypeTimeout/2)
+	defer cancel()
+
+	// A stream that never sends its type, and one of another type, must not
+	// keep the listener from accepting the stream after them.
+	silent, err := client.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	// Let the silent stream arrive first.
+	time.Sleep(50 * time.Millisecond)
+	other, err := openTypedStream(ctx, client, streamTypeRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	stream, err := openTypedStream(ctx, client, streamTypeGRPCClientToServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		buf := make([]byte, 4)
+		if _, err := conn.Read(buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("accepted the wrong stream: read %q, %v", buf, err)
+		}
+	case <-ctx.Done():
+		t.Fatal("a silent stream held up accepting the next stream")
+	}
+}
@@ -0,0 +1,157 @@
+package brpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/quic-go/quic-go"
+	"net"
+)
+
+// DefaultNextProto is the ALPN protocol that clients and servers negotiate when
+// their tls.Config leaves NextProtos empty. QUIC requires both sides to agree on
+// an ALPN protocol, so custom NextProtos must overlap between client and server.
+const DefaultNextProto = "brpc"
+
+// withDefaultNextProtos returns config with NextProtos set to DefaultNextProto
+// if it is empty. The config is cloned rather than modified.
+func withDefaultNextProtos(config *tls.Config) *tls.Config {
+	if config == nil || len(config.NextProtos) > 0 {
+		return config
+	}
+	config = config.Clone()
+	config.NextProtos = []string{DefaultNextProto}
+	return config
+}
+
+// alertNoApplicationProtocol is the TLS alert that a server sends when none of
+// the client's ALPN protocols are supported, see RFC 7301.
+const alertNoApplicationProtocol = 120
+
+// alpnError wraps err with ErrALPNMismatch if the TLS handshake failed because
+// the client and server don't support a common ALPN protocol, which quic-go and
+// crypto/tls otherwise only report as a bare TLS alert.
+func alpnError(err error, config *tls.Config) error {
+	var transportErr *quic.TransportError
+	if errors.As(err, &transportErr) && transportErr.ErrorCode == quic.TransportErrorCode(0x100+alertNoApplicationProtocol) {
+		return alpnMismatch(err, config)
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" && opErr.Err != nil && opErr.Err.Error() == "tls: no application protocol" {
+		return alpnMismatch(err, config)
+	}
+	return err
+}
+
+func alpnMismatch(err error, config *tls.Config) error {
+	var protos []string
+	if config != nil {
+		protos = config.NextProtos
+	}
+	return fmt.Errorf("%w: client offered %q: %w", ErrALPNMismatch, protos, err)
+}
+
+// DialMTLS dials a brpc server that requires mutual TLS, presenting clientCert to
+// the server and verifying the server's certificate against rootCAs.
+func DialMTLS(target string, clientCert tls.Certificate, rootCAs *x509.CertPool, opts ...DialOption) (*ClientConn, error) {
+	return Dial(target, &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      rootCAs,
+	}, opts...)
+}
+
+// verifyClientCertificate returns the client's leaf certificate if it is valid for
+// client authentication. If the TLS handshake already verified the certificate,
+// that result is used, otherwise it is verified against roots.
+func verifyClientCertificate(state tls.ConnectionState, roots *x509.CertPool) (*x509.Certificate, error) {
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		return state.VerifiedChains[0][0], nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return nil, errors.New("client did not provide a certificate")
+	}
+	if roots == nil {
+		return nil, errors.New("no client CAs configured to verify the client certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := state.PeerCertificates[0]
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+// ClientCertificate returns the verified certificate of the client with the
+// provided id. It returns false if the client isn't connected or the server
+// doesn't require client certificates.
+func (s *Server[C]) ClientCertificate(id uuid.UUID) (*x509.Certificate, bool) {
+	entry, ok := s.clients.get(id)
+	if !ok || entry.cert == nil {
+		return nil, false
+	}
+	return entry.cert, true
+}
+
+// ClientCertificateFromContext returns the verified certificate of the client that
+// made the RPC in ctx. The certificate is nil if the server doesn't require client
+// certificates.
+func (s *Server[C]) ClientCertificateFromContext(ctx context.Context) (*x509.Certificate, error) {
+	entry, err := s.entryFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return entry.cert, nil
+}
+
+// ClientTLSState returns the TLS state of the connection of the client with the
+// provided id, such as the negotiated cipher suite, the server name the client
+// asked for and its certificates. It returns false if the client isn't
+// connected. The state is the zero value if the transport doesn't use TLS.
+func (s *Server[C]) ClientTLSState(id uuid.UUID) (tls.ConnectionState, bool) {
+	entry, ok := s.clients.get(id)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return entry.tls, true
+}
+
+// ClientTLSStateFromContext returns the TLS state of the connection of the
+// client that made the RPC in ctx, see ClientTLSState.
+func (s *Server[C]) ClientTLSStateFromContext(ctx context.Context) (tls.ConnectionState, error) {
+	entry, err := s.entryFromContext(ctx)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	return entry.tls, nil
+}
+
+// ClientIDFromCertificate returns a ClientIDFunc that derives the client ID from
+// the client's TLS certificate, so that a client keeps the same ID across
+// reconnects. The raw DER bytes of the leaf certificate are passed to hash, which
+// defaults to a SHA-1 based (version 5) UUID when nil. Clients that don't present a
+// certificate are rejected, so this is best combined with RequireClientCert.
+func ClientIDFromCertificate(hash func([]byte) uuid.UUID) ClientIDFunc {
+	if hash == nil {
+		hash = func(b []byte) uuid.UUID {
+			return uuid.NewSHA1(uuid.NameSpaceOID, b)
+		}
+	}
+	return func(_ context.Context, conn Conn) (uuid.UUID, error) {
+		certs := conn.ConnectionState().PeerCertificates
+		if len(certs) == 0 {
+			return uuid.Nil, errors.New("client did not provide a certificate")
+		}
+		return hash(certs[0].Raw), nil
+	}
+}
@@ -0,0 +1,35 @@
+package brpc
+
+import (
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+)
+
+// WithTracePropagation instruments the client's gRPC connections with
+// OpenTelemetry, using the global tracer provider and propagator. Trace context
+// is injected into client->server RPCs and extracted from server->client RPCs,
+// so that together with ServerConfig.TracePropagation a single trace spans
+// client->server->client calls.
+func WithTracePropagation() DialOption {
+	return func(c *ClientConn) {
+		c.tracePropagation = true
+	}
+}
+
+// tracingDialOptions returns the dial options that inject trace context into
+// outgoing RPCs, none if tracing is disabled.
+func tracingDialOptions(enabled bool) []grpc.DialOption {
+	if !enabled {
+		return nil
+	}
+	return []grpc.DialOption{grpc.WithStatsHandler(otelgrpc.NewClientHandler())}
+}
+
+// tracingServerOptions returns the server options that extract trace context
+// from incoming RPCs, none if tracing is disabled.
+func tracingServerOptions(enabled bool) []grpc.ServerOption {
+	if !enabled {
+		return nil
+	}
+	return []grpc.ServerOption{grpc.StatsHandler(otelgrpc.NewServerHandler())}
+}
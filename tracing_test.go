@@ -0,0 +1,78 @@
+package brpc_test
+
+import (
+	"context"
+	"github.com/clarkmcc/brpc"
+	"github.com/clarkmcc/brpc/brpctest"
+	"github.com/clarkmcc/brpc/internal/example"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"testing"
+)
+
+// traceNamer answers with the id of the trace that the call belongs to.
+type traceNamer struct {
+	example.UnimplementedNamerServer
+}
+
+func (traceNamer) Name(ctx context.Context, _ *example.NameRequest) (*example.NameResponse, error) {
+	return &example.NameResponse{Name: trace.SpanContextFromContext(ctx).TraceID().String()}, nil
+}
+
+// traceGreeter answers with the id of the trace that the call belongs to, and
+// the one that the client saw on the callback made from the call.
+type traceGreeter struct {
+	example.UnimplementedGreeterServer
+	server *brpc.Server[example.NamerClient]
+}
+
+func (g *traceGreeter) Greet(ctx context.Context, _ *example.GreetRequest) (*example.GreetResponse, error) {
+	client, err := g.server.ClientFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Name(ctx, &example.NameRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return &example.GreetResponse{Greeting: trace.SpanContextFromContext(ctx).TraceID().String() + " " + res.GetName()}, nil
+}
+
+func TestTracePropagation(t *testing.T) {
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(previous) })
+
+	h := brpctest.NewHarness(t, brpctest.HarnessConfig[example.NamerClient]{
+		Server: brpc.ServerConfig[example.NamerClient]{
+			ClientServiceBuilder: example.NewNamerClient,
+			TracePropagation:     true,
+		},
+		RegisterServer: func(server *brpc.Server[example.NamerClient], registrar grpc.ServiceRegistrar) {
+			example.RegisterGreeterServer(registrar, &traceGreeter{server: server})
+		},
+		RegisterClient: func(registrar grpc.ServiceRegistrar) {
+			example.RegisterNamerServer(registrar, traceNamer{})
+		},
+		DialOptions: []brpc.DialOption{brpc.WithTracePropagation()},
+	})
+
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx, cancel := context.WithTimeout(trace.ContextWithSpanContext(context.Background(), spanContext), testTimeout)
+	defer cancel()
+	res, err := example.NewGreeterClient(h.Client).Greet(ctx, &example.GreetRequest{})
+	if err != nil {
+		t.Fatalf("Greet: %v", err)
+	}
+	// The trace spans the client->server call and the server->client callback.
+	traceID := spanContext.TraceID().String()
+	if got, want := res.GetGreeting(), traceID+" "+traceID; got != want {
+		t.Errorf("got trace ids %q, want %q", got, want)
+	}
+}
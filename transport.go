@@ -0,0 +1,93 @@
+package brpc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Transport establishes brpc connections. QUICTransport is used by default,
+// YamuxTransport runs brpc over TCP for networks where UDP is blocked.
+type Transport interface {
+	// Dial connects to the server at target. A nil config may be rejected by
+	// transports that require TLS.
+	Dial(ctx context.Context, target string, config *tls.Config) (Conn, error)
+	// Listen listens for connections on addr.
+	Listen(addr string, config *tls.Config) (Listener, error)
+}
+
+// Conn is a connection between a brpc client and server that multiplexes streams.
+// The client ID handshake runs over unidirectional streams, and the gRPC
+// connections in both directions each run over a bidirectional stream.
+//
+// Every bidirectional stream starts with a byte written by the side that opened
+// it, which tells the accepting side what the stream is for: the client->server
+// gRPC connection, the server->client gRPC connection, or a raw stream opened
+// with ClientConn.OpenRawStream. Each side's gRPC server only accepts streams of
+// the type meant for it, and streams of unknown types are closed.
+//
+// WrapQUICConn and NewYamuxConn adapt QUIC connections and yamux sessions.
+type Conn interface {
+	// OpenStream opens a bidirectional stream, blocking until the peer allows it.
+	OpenStream(ctx context.Context) (net.Conn, error)
+	// AcceptStream returns the next bidirectional stream opened by the peer.
+	AcceptStream(ctx context.Context) (net.Conn, error)
+	// OpenUniStream opens a stream that only this side writes to.
+	OpenUniStream(ctx context.Context) (SendStream, error)
+	// AcceptUniStream returns the next unidirectional stream opened by the peer.
+	AcceptUniStream(ctx context.Context) (ReceiveStream, error)
+	// Context is done once the connection is closed. Its cause describes why
+	// the connection was closed, see ReasonFromError.
+	Context() context.Context
+	// CloseWithReason closes the connection and tells the peer why.
+	CloseWithReason(reason Reason, message string) error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	// ConnectionState returns the TLS state of the connection, which is the zero
+	// value if the connection doesn't use TLS.
+	ConnectionState() tls.ConnectionState
+}
+
+// SendStream is the writing side of a unidirectional stream.
+type SendStream interface {
+	io.WriteCloser
+	SetWriteDeadline(t time.Time) error
+}
+
+// ReceiveStream is the reading side of a unidirectional stream.
+type ReceiveStream interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+}
+
+// Listener accepts brpc connections, see Server.ServeListener.
+type Listener interface {
+	// Accept returns the next connection, blocking until one arrives or ctx is done.
+	Accept(ctx context.Context) (Conn, error)
+	// Close stops accepting connections. Connections that were already accepted
+	// stay open.
+	Close() error
+	Addr() net.Addr
+}
+
+// CloseError is the cause of a Conn's context once the connection was closed
+// with a Reason by a transport that doesn't report its own application errors.
+type CloseError struct {
+	Reason  Reason
+	Message string
+	Remote  bool // Whether the peer closed the connection
+}
+
+func (e *CloseError) Error() string {
+	side := "local"
+	if e.Remote {
+		side = "remote"
+	}
+	if e.Message == "" {
+		return fmt.Sprintf("connection closed (%s): %s", side, e.Reason)
+	}
+	return fmt.Sprintf("connection closed (%s): %s: %s", side, e.Reason, e.Message)
+}
@@ -0,0 +1,160 @@
+package brpc
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/quic-go/quic-go"
+	"net"
+)
+
+var _ Transport = QUICTransport{}
+
+// QUICTransport is a Transport that connects over QUIC. TLS configs that leave
+// NextProtos empty negotiate DefaultNextProto.
+type QUICTransport struct {
+	// Config is passed to quic-go when dialing and listening, nil uses the
+	// quic-go defaults.
+	Config *quic.Config
+}
+
+func (t QUICTransport) Dial(ctx context.Context, target string, config *tls.Config) (Conn, error) {
+	conn, err := quic.DialAddr(ctx, target, withDefaultNextProtos(config), t.Config)
+	if err != nil {
+		return nil, err
+	}
+	return WrapQUICConn(conn), nil
+}
+
+func (t QUICTransport) Listen(addr string, config *tls.Config) (Listener, error) {
+	listener, err := quic.ListenAddr(addr, withDefaultNextProtos(config), t.Config)
+	if err != nil {
+		return nil, err
+	}
+	return WrapQUICListener(listener), nil
+}
+
+// NewQUICListener creates a QUIC listener on a UDP socket that the caller bound
+// itself, for example with SO_REUSEPORT or from socket activation, to pass to
+// Server.Serve. TLS configs that leave NextProtos empty negotiate
+// DefaultNextProto, a nil quicConfig uses the quic-go defaults. Closing the
+// listener, which Server.Serve does once the server stopped, doesn't close pc,
+// which remains owned by the caller.
+func NewQUICListener(pc net.PacketConn, tlsConfig *tls.Config, quicConfig *quic.Config) (*quic.Listener, error) {
+	return quic.Listen(pc, withDefaultNextProtos(tlsConfig), quicConfig)
+}
+
+// WrapQUICConn adapts a QUIC connection to a Conn.
+func WrapQUICConn(conn quic.Connection) Conn {
+	return &quicConnection{conn: conn}
+}
+
+// WrapQUICListener adapts a QUIC listener to a Listener. Closing the returned
+// listener closes the QUIC listener.
+func WrapQUICListener(listener *quic.Listener) Listener {
+	return &quicConnListener{listener: listener}
+}
+
+var _ Conn = &quicConnection{}
+
+// quicConnection implements Conn on top of a quic.Connection.
+type quicConnection struct {
+	conn quic.Connection
+}
+
+func (q *quicConnection) OpenStream(ctx context.Context) (net.Conn, error) {
+	stream, err := q.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{Stream: stream, conn: q.conn}, nil
+}
+
+func (q *quicConnection) AcceptStream(ctx context.Context) (net.Conn, error) {
+	stream, err := q.conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{Stream: stream, conn: q.conn}, nil
+}
+
+func (q *quicConnection) OpenUniStream(ctx context.Context) (SendStream, error) {
+	return q.conn.OpenUniStreamSync(ctx)
+}
+
+func (q *quicConnection) AcceptUniStream(ctx context.Context) (ReceiveStream, error) {
+	return q.conn.AcceptUniStream(ctx)
+}
+
+func (q *quicConnection) Context() context.Context {
+	return q.conn.Context()
+}
+
+func (q *quicConnection) CloseWithReason(reason Reason, message string) error {
+	return q.conn.CloseWithError(quic.ApplicationErrorCode(reason), message)
+}
+
+func (q *quicConnection) LocalAddr() net.Addr {
+	return q.conn.LocalAddr()
+}
+
+func (q *quicConnection) RemoteAddr() net.Addr {
+	return q.conn.RemoteAddr()
+}
+
+func (q *quicConnection) ConnectionState() tls.ConnectionState {
+	return q.conn.ConnectionState().TLS
+}
+
+var _ Listener = &quicConnListener{}
+
+// quicConnListener implements Listener on top of a quic.Listener.
+type quicConnListener struct {
+	listener *quic.Listener
+}
+
+func (q *quicConnListener) Accept(ctx context.Context) (Conn, error) {
+	conn, err := q.listener.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return WrapQUICConn(conn), nil
+}
+
+func (q *quicConnListener) Close() error {
+	return q.listener.Close()
+}
+
+func (q *quicConnListener) Addr() net.Addr {
+	return q.listener.Addr()
+}
+
+var _ net.Conn = &quicConn{}
+
+// quicConn is a net.Conn implementation that wraps a quic.Stream. Its addresses
+// are those of the QUIC connection that the stream belongs to.
+type quicConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+// Close closes both directions of the stream. quic.Stream.Close only closes the
+// send direction, which would leave gRPC's reader blocked on a half-closed stream
+// and leak the transport when a streaming RPC's connection is torn down.
+func (q *quicConn) Close() error {
+	q.Stream.CancelRead(0)
+	return q.Stream.Close()
+}
+
+// CloseWrite closes the send direction of the stream, so the peer reads io.EOF
+// while the stream stays readable.
+func (q *quicConn) CloseWrite() error {
+	return q.Stream.Close()
+}
+
+func (q *quicConn) LocalAddr() net.Addr {
+	return q.conn.LocalAddr()
+}
+
+func (q *quicConn) RemoteAddr() net.Addr {
+	return q.conn.RemoteAddr()
+}
@@ -0,0 +1,409 @@
+package brpc
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"go.uber.org/multierr"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Every yamux stream starts with one of these bytes so that the accepting side
+// can tell unidirectional streams, bidirectional streams and close notifications
+// apart, which QUIC does natively.
+const (
+	yamuxStreamBidi byte = iota + 1
+	yamuxStreamUni
+	yamuxStreamClose
+)
+
+// yamuxPrefaceTimeout bounds how long an accepted stream may take to send its preface.
+const yamuxPrefaceTimeout = 10 * time.Second
+
+// yamuxCloseTimeout bounds how long closing a connection waits for the close
+// notification to be written to the peer.
+const yamuxCloseTimeout = time.Second
+
+// maxCloseMessage is the longest close message that is sent to or read from the peer.
+const maxCloseMessage = 1024
+
+var _ Transport = YamuxTransport{}
+
+// YamuxTransport is a Transport that multiplexes connections over TCP with yamux.
+// Connections use TLS unless the config passed to Dial and Listen is nil.
+type YamuxTransport struct {
+	// Config configures the yamux sessions, see NewYamuxConn.
+	Config *yamux.Config
+	// Dialer is used to open TCP connections, the zero value is used when nil.
+	Dialer *net.Dialer
+}
+
+func (t YamuxTransport) Dial(ctx context.Context, target string, config *tls.Config) (Conn, error) {
+	dialer := t.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	var conn net.Conn
+	var err error
+	if config == nil {
+		conn, err = dialer.DialContext(ctx, "tcp", target)
+	} else {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: config}).DialContext(ctx, "tcp", target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewYamuxConn(conn, false, t.Config)
+	if err != nil {
+		return nil, multierr.Append(err, conn.Close())
+	}
+	return c, nil
+}
+
+func (t YamuxTransport) Listen(addr string, config *tls.Config) (Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+	return NewYamuxListener(listener, t.Config), nil
+}
+
+// NewYamuxConn multiplexes a Conn over conn with yamux, for networks where QUIC
+// can't be used. Exactly one side of conn must pass server=true. If conn is a
+// *tls.Conn, its handshake must already be complete for ConnectionState to
+// report the peer's certificates. A nil config uses yamux.DefaultConfig without
+// logging.
+func NewYamuxConn(conn net.Conn, server bool, config *yamux.Config) (Conn, error) {
+	if config == nil {
+		config = yamux.DefaultConfig()
+		config.LogOutput = io.Discard
+	}
+	var session *yamux.Session
+	var err error
+	if server {
+		session, err = yamux.Server(conn, config)
+	} else {
+		session, err = yamux.Client(conn, config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating yamux session: %w", err)
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	c := &yamuxConn{
+		conn:       conn,
+		session:    session,
+		ctx:        ctx,
+		cancel:     cancel,
+		streams:    make(chan net.Conn),
+		uniStreams: make(chan *yamux.Stream),
+	}
+	go c.acceptLoop()
+	return c, nil
+}
+
+var _ Conn = &yamuxConn{}
+
+// yamuxConn implements Conn on top of a yamux session.
+type yamuxConn struct {
+	conn       net.Conn
+	session    *yamux.Session
+	ctx        context.Context // Cancelled with the reason once the session is closed
+	cancel     context.CancelCauseFunc
+	streams    chan net.Conn
+	uniStreams chan *yamux.Stream
+	closeOnce  sync.Once
+}
+
+// acceptLoop accepts streams until the session is closed and routes them by
+// their preface.
+func (c *yamuxConn) acceptLoop() {
+	// Wait for the prefaces of streams that were accepted before the session
+	// closed, one of them may be the close notification explaining why.
+	var prefaces sync.WaitGroup
+	for {
+		stream, err := c.session.AcceptStream()
+		if err != nil {
+			prefaces.Wait()
+			c.close(fmt.Errorf("%w: %w", net.ErrClosed, err))
+			return
+		}
+		prefaces.Add(1)
+		go c.route(stream, prefaces.Done)
+	}
+}
+
+func (c *yamuxConn) route(stream *yamux.Stream, done func()) {
+	_ = stream.SetReadDeadline(time.Now().Add(yamuxPrefaceTimeout))
+	var preface [1]byte
+	if _, err := io.ReadFull(stream, preface[:]); err != nil {
+		done()
+		_ = stream.Close()
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+	if preface[0] == yamuxStreamClose {
+		c.close(readCloseError(stream))
+		done()
+		return
+	}
+	done()
+
+	switch preface[0] {
+	case yamuxStreamBidi:
+		select {
+		case c.streams <- &yamuxStream{Stream: stream}:
+		case <-c.ctx.Done():
+			_ = stream.Close()
+		}
+	case yamuxStreamUni:
+		select {
+		case c.uniStreams <- stream:
+		case <-c.ctx.Done():
+			_ = stream.Close()
+		}
+	default:
+		_ = stream.Close()
+	}
+}
+
+// readCloseError reads the close notification sent by CloseWithReason.
+func readCloseError(stream *yamux.Stream) error {
+	_ = stream.SetReadDeadline(time.Now().Add(yamuxCloseTimeout))
+	var code [8]byte
+	if _, err := io.ReadFull(stream, code[:]); err != nil {
+		return fmt.Errorf("%w: reading close reason: %w", net.ErrClosed, err)
+	}
+	message, _ := io.ReadAll(io.LimitReader(stream, maxCloseMessage))
+	return &CloseError{
+		Reason:  Reason(binary.BigEndian.Uint64(code[:])),
+		Message: string(message),
+		Remote:  true,
+	}
+}
+
+// close closes the session, the first cause passed to close is kept as the
+// cause of the connection's context.
+func (c *yamuxConn) close(cause error) {
+	c.cancel(cause)
+	c.closeOnce.Do(func() {
+		_ = c.session.Close()
+	})
+}
+
+func (c *yamuxConn) openStream(ctx context.Context, kind byte) (*yamux.Stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.ctx.Err() != nil {
+		return nil, context.Cause(c.ctx)
+	}
+	stream, err := c.session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetWriteDeadline(deadline)
+	}
+	if _, err := stream.Write([]byte{kind}); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	_ = stream.SetWriteDeadline(time.Time{})
+	return stream, nil
+}
+
+func (c *yamuxConn) OpenStream(ctx context.Context) (net.Conn, error) {
+	stream, err := c.openStream(ctx, yamuxStreamBidi)
+	if err != nil {
+		return nil, err
+	}
+	return &yamuxStream{Stream: stream}, nil
+}
+
+func (c *yamuxConn) AcceptStream(ctx context.Context) (net.Conn, error) {
+	select {
+	case stream := <-c.streams:
+		return stream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, context.Cause(c.ctx)
+	}
+}
+
+func (c *yamuxConn) OpenUniStream(ctx context.Context) (SendStream, error) {
+	return c.openStream(ctx, yamuxStreamUni)
+}
+
+func (c *yamuxConn) AcceptUniStream(ctx context.Context) (ReceiveStream, error) {
+	select {
+	case stream := <-c.uniStreams:
+		return &yamuxReceiveStream{Stream: stream}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, context.Cause(c.ctx)
+	}
+}
+
+func (c *yamuxConn) Context() context.Context {
+	return c.ctx
+}
+
+// CloseWithReason sends reason to the peer on a dedicated stream before closing
+// the session, since yamux itself can't carry an error code.
+func (c *yamuxConn) CloseWithReason(reason Reason, message string) error {
+	if c.ctx.Err() != nil {
+		return nil
+	}
+	if len(message) > maxCloseMessage {
+		message = message[:maxCloseMessage]
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), yamuxCloseTimeout)
+	defer cancel()
+	stream, err := c.openStream(ctx, yamuxStreamClose)
+	if err == nil {
+		buf := binary.BigEndian.AppendUint64(nil, uint64(reason))
+		_ = stream.SetWriteDeadline(time.Now().Add(yamuxCloseTimeout))
+		_, err = stream.Write(append(buf, message...))
+		err = multierr.Append(err, stream.Close())
+	}
+	c.close(&CloseError{Reason: reason, Message: message})
+	if err != nil && !errors.Is(err, yamux.ErrSessionShutdown) {
+		return fmt.Errorf("notifying peer of close: %w", err)
+	}
+	return nil
+}
+
+func (c *yamuxConn) LocalAddr() net.Addr {
+	return c.session.LocalAddr()
+}
+
+func (c *yamuxConn) RemoteAddr() net.Addr {
+	return c.session.RemoteAddr()
+}
+
+func (c *yamuxConn) ConnectionState() tls.ConnectionState {
+	if conn, ok := c.conn.(*tls.Conn); ok {
+		return conn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// yamuxStream is a bidirectional yamux stream that can be half-closed.
+type yamuxStream struct {
+	*yamux.Stream
+}
+
+// CloseWrite closes the send direction of the stream, so the peer reads io.EOF
+// while the stream stays readable. Closing a yamux stream only closes the send
+// direction too, the stream is released once both sides closed it.
+func (s *yamuxStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// yamuxReceiveStream closes the stream once the peer has finished writing, so
+// that readers of unidirectional streams don't have to.
+type yamuxReceiveStream struct {
+	*yamux.Stream
+}
+
+func (s *yamuxReceiveStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if err == io.EOF {
+		_ = s.Stream.Close()
+	}
+	return n, err
+}
+
+// NewYamuxListener returns a Listener that accepts connections from listener and
+// multiplexes them with yamux, see NewYamuxConn. TLS handshakes of *tls.Conn
+// connections, such as those returned by tls.NewListener, are completed before
+// the connection is returned from Accept.
+func NewYamuxListener(listener net.Listener, config *yamux.Config) Listener {
+	l := &yamuxListener{
+		listener: listener,
+		config:   config,
+		conns:    make(chan Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+var _ Listener = &yamuxListener{}
+
+type yamuxListener struct {
+	listener  net.Listener
+	config    *yamux.Config
+	conns     chan Conn
+	err       error // Set before done is closed
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *yamuxListener) acceptLoop() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *yamuxListener) handshake(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultHandshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+	c, err := NewYamuxConn(conn, true, l.config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		_ = c.CloseWithReason(ReasonShutdown, ReasonShutdown.String())
+	}
+}
+
+func (l *yamuxListener) Accept(ctx context.Context) (Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *yamuxListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		err = l.listener.Close()
+	})
+	return err
+}
+
+func (l *yamuxListener) Addr() net.Addr {
+	return l.listener.Addr()
+}